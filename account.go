@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+)
+
+// accountDeleteHandler confirms on GET and on POST removes everything the
+// app holds for the user: the provider token, cached API responses and the
+// Redis records of their sessions on every device. Sessions are also
+// invalidated by bumping the user's session generation, which catches any
+// the per-user session set missed; the generation counter is the only thing
+// kept, since resetting it would make those sessions valid again.
+// Every step is attempted even if an earlier one fails. Without a shared
+// session store the other sessions cannot be invalidated, so deletion is
+// refused rather than leaving them logged in.
+func (s *Server) accountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionFromContext(r.Context())
+	if !s.canRevokeSessions() {
+		s.renderRevocationUnsupported(w, r, "Account deletion unavailable")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		data := struct {
+			Lang      string
+			CSRFToken string
+		}{
+			Lang:      requestLang(r),
+			CSRFToken: s.ensureCSRFToken(w, r, session),
+		}
+		s.renderTemplate(w, r, "account_delete", data)
+		return
+	}
+
+	if !validCSRFToken(r, session) {
+		s.renderError(w, r, http.StatusForbidden, "Invalid request", "The form has expired, please go back and try again.")
+		return
+	}
+
+	user := s.sessionUserKey(session)
+	log := s.log(r).With("path", r.URL.Path, "user", user)
+
+	s.revokeToken(r, session)
+
+	if _, err := s.generations.Bump(user); err != nil {
+		log.Error("Failed to invalidate other sessions", "error", err)
+	}
+
+	if err := s.deleteUserSessions(user); err != nil {
+		log.Error("Failed to delete other sessions", "error", err)
+	}
+
+	s.repoCache.Delete(user)
+
+	// A negative MaxAge makes the store delete the server-side record, if
+	// any, and expire the cookie.
+	session.Values = make(map[interface{}]interface{})
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		log.Error("Failed to delete session", "error", err)
+	}
+
+	log.Info("Account data deleted")
+	http.Redirect(w, r, s.path(r, "/?account_deleted=1"), http.StatusSeeOther)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAccountDelete(t *testing.T) {
+	redis := newFakeRedis(t)
+	s := newTestServer(t, newFakeGitHub(t, nil), "SESSION_BACKEND=redis", "REDIS_URL="+redis.URL())
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	laptop, phone := newBrowser(t), newBrowser(t)
+	login(t, laptop, app.URL, "")
+	login(t, phone, app.URL, "")
+
+	_, page := get(t, laptop, app.URL+"/account/delete")
+	resp, _ := postForm(t, laptop, app.URL+"/account/delete", url.Values{"csrf_token": {csrfToken(t, page)}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/?account_deleted=1" {
+		t.Fatalf("POST /account/delete: status %d, Location %q, want %d to /?account_deleted=1",
+			resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+
+	// Only the generation counter is left: no device's session record
+	// still holds the user's profile or token.
+	for key := range redis.keys("session_") {
+		if !strings.HasPrefix(key, "session_generation:") {
+			t.Errorf("session record %s kept after account deletion", key)
+		}
+	}
+	if sets := redis.keys("user_sessions:"); len(sets) != 0 {
+		t.Errorf("session sets %v kept after account deletion", sets)
+	}
+
+	for name, c := range map[string]*http.Client{"same device": laptop, "other device": phone} {
+		if resp, _ := get(t, c, app.URL+"/profile"); resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("GET /profile on the %s: status %d, want %d", name, resp.StatusCode, http.StatusSeeOther)
+		}
+	}
+}
+
+func TestAccountDeleteNeedsSharedStore(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil))
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+	login(t, c, app.URL, "")
+
+	_, profile := get(t, c, app.URL+"/profile")
+	resp, _ := postForm(t, c, app.URL+"/account/delete", url.Values{"csrf_token": {csrfToken(t, profile)}})
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("POST /account/delete with cookie sessions: status %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+	}
+	if resp, _ := get(t, c, app.URL+"/profile"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /profile after refused deletion: status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var defaultAvatarHosts = []string{
+	"avatars.githubusercontent.com",
+	"secure.gravatar.com",
+	"gitlab.com",
+	".googleusercontent.com",
+}
+
+// enterpriseAvatarHosts are the hosts a GitHub Enterprise Server at
+// GITHUB_BASE_URL serves avatars from: itself under /avatars, or
+// avatars.<host> with subdomain isolation.
+func enterpriseAvatarHosts(cfg *Config) []string {
+	host := urlHost(cfg.GitHubBaseURL)
+	if host == "" {
+		return nil
+	}
+	return []string{host, "avatars." + host}
+}
+
+func avatarHosts(cfg *Config) []string {
+	return append(slices.Clone(defaultAvatarHosts), enterpriseAvatarHosts(cfg)...)
+}
+
+// normalizeAvatarURL returns raw re-encoded if it is an https URL on one of
+// hosts, and "" otherwise.
+func normalizeAvatarURL(raw string, hosts []string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return ""
+	}
+	if !hostAllowed(strings.ToLower(u.Hostname()), hosts) {
+		return ""
+	}
+	return u.String()
+}
+
+// avatarPolicy allows fetching avatarURL from its host. An Enterprise
+// Server's avatars may, like its API, live on a private network.
+func (s *Server) avatarPolicy(avatarURL string) fetchPolicy {
+	if enterprise := enterpriseAvatarHosts(s.cfg); hostAllowed(urlHost(avatarURL), enterprise) {
+		return fetchPolicy{hosts: enterprise, allowInternal: true}
+	}
+	return fetchPolicy{hosts: defaultAvatarHosts}
+}
+
+// avatarSrc is the image URL templates should render for avatarURL: the
+// local proxy under prefix when AVATAR_PROXY is enabled, otherwise the
+// provider's URL. The proxied path embeds avatarHash, so a new avatar gets
+// a new URL and is never hidden behind the cached one.
+func (s *Server) avatarSrc(prefix, avatarURL string) string {
+	if s.cfg.AvatarProxy && avatarURL != "" {
+		return prefix + "/avatar/" + avatarHash(avatarURL)
+	}
+	return avatarURL
+}
+
+func avatarHash(avatarURL string) string {
+	sum := sha256.Sum256([]byte(avatarURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Server) avatarHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.AvatarProxy {
+		s.notFound(w, r)
+		return
+	}
+
+	// Only the current session's avatar is served; a stale or guessed hash
+	// is a 404 rather than whatever a cache may still hold for it.
+	avatarURL := getStringFromSession(sessionFromContext(r.Context()), keyAvatarURL)
+	hash := strings.TrimPrefix(r.URL.Path, "/avatar/")
+	if normalizeAvatarURL(avatarURL, s.avatarHosts) == "" || hash != avatarHash(avatarURL) {
+		s.notFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.GitHubTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := safeFetch(s.httpClient, req, s.avatarPolicy(avatarURL))
+	if err != nil {
+		s.log(r).Warn("Failed to fetch avatar", "path", r.URL.Path, "error", err)
+		s.renderError(w, r, http.StatusBadGateway, "Avatar unavailable", "Failed to fetch avatar.")
+		return
+	}
+	defer resp.Body.Close()
+
+	// Check the response before setting the cache headers, so an error
+	// page is not cached as the avatar.
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+	case resp.StatusCode != http.StatusOK, !strings.HasPrefix(contentType, "image/"):
+		s.renderError(w, r, http.StatusBadGateway, "Avatar unavailable", "Failed to fetch avatar.")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "private, max-age=86400")
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		h.Set("ETag", etag)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Type", contentType)
+	if resp.ContentLength > 0 {
+		h.Set("Content-Length", resp.Header.Get("Content-Length"))
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		s.log(r).Warn("Failed to stream avatar", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a concurrency-safe in-memory cache whose entries expire after
+// a fixed TTL. Expired entries are swept lazily on Set and Add. Hits and
+// misses are counted in the cache_requests_total metric under the cache's
+// name.
+type ttlCache[V any] struct {
+	name      string
+	ttl       time.Duration
+	mu        sync.RWMutex
+	entries   map[string]cacheEntry[V]
+	lastSweep time.Time
+}
+
+func newTTLCache[V any](name string, ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		name:    name,
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry[V]),
+	}
+}
+
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if !ok || time.Now().After(e.expires) {
+		cacheRequests.WithLabelValues(c.name, "miss").Inc()
+		var zero V
+		return zero, false
+	}
+	cacheRequests.WithLabelValues(c.name, "hit").Inc()
+	return e.value, true
+}
+
+func (c *ttlCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+}
+
+// Add stores value under key unless an unexpired entry is already there,
+// and reports whether it did. The check and the store are atomic.
+func (c *ttlCache[V]) Add(key string, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	if e, ok := c.entries[key]; ok && !now.After(e.expires) {
+		return false
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+	return true
+}
+
+// sweep drops expired entries at most once per TTL. c.mu must be held.
+func (c *ttlCache[V]) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) <= c.ttl {
+		return
+	}
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *ttlCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheAdd(t *testing.T) {
+	c := newTTLCache[struct{}]("test", 50*time.Millisecond)
+
+	if !c.Add("nonce", struct{}{}) {
+		t.Fatal("first Add of a key returned false")
+	}
+	if c.Add("nonce", struct{}{}) {
+		t.Fatal("second Add of the same key returned true")
+	}
+	if !c.Add("other", struct{}{}) {
+		t.Fatal("Add of a different key returned false")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !c.Add("nonce", struct{}{}) {
+		t.Fatal("Add after the entry expired returned false")
+	}
+}
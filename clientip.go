@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+}
+
+func parseTrustedProxies(raw string) ([]*net.IPNet, error) {
+	entries := defaultTrustedProxies
+	if strings.TrimSpace(raw) != "" {
+		entries = strings.Split(raw, ",")
+	}
+
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: must be an IP or CIDR", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. When
+// TRUST_PROXY is set and the request arrived from a trusted proxy, the
+// X-Forwarded-For chain is walked from the nearest hop outwards and the first
+// address that is not itself a trusted proxy is returned. Walking from the
+// right means a client cannot spoof its address by prepending entries.
+func (s *Server) clientIP(r *http.Request) string {
+	remote := remoteHost(r.RemoteAddr)
+	if !s.fromTrustedProxy(r) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(remoteHost(strings.TrimSpace(hops[i])))
+		if ip == nil {
+			continue
+		}
+		if !s.isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return remote
+}
+
+// fromTrustedProxy reports whether TRUST_PROXY is set and r came directly
+// from a trusted proxy, so its X-Forwarded-* headers can be believed.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	if !s.cfg.TrustProxy {
+		return false
+	}
+	ip := net.ParseIP(remoteHost(r.RemoteAddr))
+	return ip != nil && s.isTrustedProxy(ip)
+}
+
+// remoteHost strips an optional port from addr, accepting bare IPv4/IPv6
+// addresses as well as host:port and [v6]:port forms.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
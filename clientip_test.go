@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		trustProxy bool
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", false, "203.0.113.7:51234", nil, "203.0.113.7"},
+		{"forwarded header ignored without TRUST_PROXY", false, "10.0.0.2:443", []string{"198.51.100.1"}, "10.0.0.2"},
+		{"forwarded header from an untrusted peer", true, "203.0.113.7:51234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one trusted proxy", true, "10.0.0.2:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", true, "10.0.0.2:443", []string{"198.51.100.1, 192.168.1.5, 10.0.0.3"}, "198.51.100.1"},
+		{"spoofed leftmost entry", true, "10.0.0.2:443", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"repeated headers", true, "10.0.0.2:443", []string{"1.1.1.1", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"entries with ports", true, "10.0.0.2:443", []string{"[2001:db8::1]:4711, 10.0.0.3:80"}, "2001:db8::1"},
+		{"garbage skipped", true, "10.0.0.2:443", []string{"198.51.100.1, not-an-ip"}, "198.51.100.1"},
+		{"only trusted hops", true, "10.0.0.2:443", []string{"10.0.0.3, 192.168.1.5"}, "10.0.0.2"},
+		{"IPv6 remote", false, "[2001:db8::7]:443", nil, "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: &Config{TrustProxy: tt.trustProxy, TrustedProxies: proxies}}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies(" 203.0.113.7, 2001:db8::/32 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	if len(got) != 2 || got[0] != "203.0.113.7/32" || got[1] != "2001:db8::/32" {
+		t.Errorf("parseTrustedProxies = %v, want [203.0.113.7/32 2001:db8::/32]", got)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parseTrustedProxies accepted an invalid CIDR")
+	}
+}
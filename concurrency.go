@@ -0,0 +1,33 @@
+package main
+
+import "net/http"
+
+// limitConcurrency caps the number of requests handled at once at
+// MAX_CONCURRENT_REQUESTS. A request arriving while every slot is taken is
+// turned away with a 503 straight away instead of queuing. Health checks
+// and metrics bypass the limit so monitoring keeps working under load.
+func (s *Server) limitConcurrency(next http.Handler) http.Handler {
+	limit := s.cfg.MaxConcurrentRequests
+	if limit <= 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			s.log(r).Warn("Concurrency limit reached", "path", r.URL.Path, "limit", limit)
+			w.Header().Set("Retry-After", "1")
+			s.renderError(w, r, http.StatusServiceUnavailable, "Server busy", "Server busy, please try again shortly.")
+		}
+	})
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config is everything the server reads from the environment. It is loaded
+// once at startup by loadConfig and not modified afterwards.
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// GitHubBaseURL is set for GitHub Enterprise Server and replaces
+	// github.com in the OAuth endpoints. GitHubAPIURL always has a value.
+	GitHubBaseURL string
+	GitHubAPIURL  string
+
+	// AllowedOrgs and AllowedUsers, when set, restrict login to members of
+	// these GitHub organizations or to these GitHub logins. Names are
+	// lowercased.
+	AllowedOrgs  []string
+	AllowedUsers []string
+
+	GitLabClientID     string
+	GitLabClientSecret string
+	GoogleClientID     string
+	GoogleClientSecret string
+
+	// BasePath is the prefix the app is mounted under, e.g. "/auth". It is
+	// empty when serving from the root and never ends in a slash.
+	BasePath    string
+	Addr        string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	SessionName  string
+	CookieDomain string
+	// SessionSecrets has at least one entry. The first signs new cookies;
+	// the rest only verify cookies signed before a rotation.
+	SessionSecrets      [][]byte
+	SessionBackend      string
+	RedisURL            string
+	SessionMaxAge       time.Duration
+	SessionIdleTimeout  time.Duration
+	RememberIdleTimeout time.Duration
+	CookieSecure        bool
+
+	UserAgent          string
+	GitHubTimeout      time.Duration
+	TokenRefreshWindow time.Duration
+	OutboundProxyURL   *url.URL
+	OutboundCAFile     string
+	OutboundTimeout    time.Duration
+
+	MaxRequestBodyBytes int64
+	// MaxConcurrentRequests is 0 when in-flight requests are unlimited.
+	MaxConcurrentRequests int
+
+	ReposMaxPages      int
+	CacheTTL           time.Duration
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	TrustProxy         bool
+	TrustedProxies     []*net.IPNet
+
+	ContentSecurityPolicy string
+	AvatarProxy           bool
+	GitHubLogoutLink      bool
+	StartupProbe          bool
+	Dev                   bool
+}
+
+const defaultUserAgent = "github-login-example"
+
+// loadConfig reads the configuration from the environment, loading .env
+// first if present. Every invalid or missing setting is reported in the
+// returned error rather than stopping at the first one.
+func loadConfig() (*Config, error) {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(loadDotEnv(".env"))
+
+	cfg := &Config{
+		ClientID:              os.Getenv("GITHUB_CLIENT_ID"),
+		RedirectURL:           os.Getenv("GITHUB_REDIRECT_URL"),
+		Scopes:                parseScopes(os.Getenv("GITHUB_SCOPES")),
+		AllowedOrgs:           splitList(strings.ToLower(os.Getenv("ALLOWED_ORGS"))),
+		AllowedUsers:          splitList(strings.ToLower(os.Getenv("ALLOWED_USERS"))),
+		GitLabClientID:        os.Getenv("GITLAB_CLIENT_ID"),
+		GoogleClientID:        os.Getenv("GOOGLE_CLIENT_ID"),
+		SessionName:           os.Getenv("SESSION_NAME"),
+		SessionBackend:        os.Getenv("SESSION_BACKEND"),
+		RedisURL:              os.Getenv("REDIS_URL"),
+		OutboundCAFile:        os.Getenv("OUTBOUND_CA_FILE"),
+		UserAgent:             os.Getenv("USER_AGENT"),
+		ContentSecurityPolicy: os.Getenv("CONTENT_SECURITY_POLICY"),
+	}
+
+	var err error
+	cfg.ClientSecret, err = secretFromEnv("GITHUB_CLIENT_SECRET")
+	check(err)
+	cfg.GitLabClientSecret, err = secretFromEnv("GITLAB_CLIENT_SECRET")
+	check(err)
+	cfg.GoogleClientSecret, err = secretFromEnv("GOOGLE_CLIENT_SECRET")
+	check(err)
+	sessionSecret, err := secretFromEnv("SESSION_SECRET")
+	check(err)
+	for _, secret := range strings.Split(sessionSecret, ",") {
+		cfg.SessionSecrets = append(cfg.SessionSecrets, []byte(strings.TrimSpace(secret)))
+	}
+
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		errs = append(errs, errors.New("GitHub OAuth credentials not set: set GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET (or GITHUB_CLIENT_SECRET_FILE)"))
+	}
+
+	cfg.BasePath, err = basePath(os.Getenv("BASE_PATH"))
+	check(err)
+
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = "http://localhost:8080" + cfg.BasePath + "/callback"
+	}
+	check(validateRedirectURL(cfg.RedirectURL))
+
+	// Listing a user's organizations needs read:org or a scope implying it.
+	if len(cfg.AllowedOrgs) > 0 && !slices.ContainsFunc(cfg.Scopes, func(scope string) bool {
+		return scope == "read:org" || scope == "write:org" || scope == "admin:org"
+	}) {
+		cfg.Scopes = append(cfg.Scopes, "read:org")
+	}
+
+	cfg.GitHubBaseURL, cfg.GitHubAPIURL, err = githubURLs()
+	check(err)
+
+	for i, secret := range cfg.SessionSecrets {
+		if len(secret) < minSessionSecretLen {
+			errs = append(errs, fmt.Errorf("SESSION_SECRET key %d must be at least %d bytes: generate a strong one with: openssl rand -base64 32", i+1, minSessionSecretLen))
+		}
+	}
+
+	if cfg.SessionName == "" {
+		cfg.SessionName = "session"
+	}
+	if !validCookieName(cfg.SessionName) {
+		errs = append(errs, fmt.Errorf("invalid SESSION_NAME %q: must be letters, digits, '-', '_' or '.'", cfg.SessionName))
+	}
+
+	cfg.CookieDomain, err = cookieDomain(os.Getenv("COOKIE_DOMAIN"), cfg.RedirectURL)
+	check(err)
+
+	switch cfg.SessionBackend {
+	case "":
+		cfg.SessionBackend = "cookie"
+	case "cookie", "redis", "jwt":
+	default:
+		errs = append(errs, fmt.Errorf("invalid SESSION_BACKEND %q: must be cookie, redis or jwt", cfg.SessionBackend))
+	}
+
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent + "/" + version
+	}
+
+	if cfg.ContentSecurityPolicy == "" {
+		cfg.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
+
+	cfg.Addr, err = listenAddr()
+	check(err)
+	cfg.TLSCertFile, cfg.TLSKeyFile, err = tlsFiles()
+	check(err)
+
+	cfg.Dev, err = boolFromEnv("DEV", false)
+	check(err)
+	cfg.AvatarProxy, err = boolFromEnv("AVATAR_PROXY", false)
+	check(err)
+	cfg.GitHubLogoutLink, err = boolFromEnv("GITHUB_LOGOUT_LINK", false)
+	check(err)
+	cfg.StartupProbe, err = boolFromEnv("STARTUP_PROBE", false)
+	check(err)
+	cfg.CookieSecure, err = boolFromEnv("COOKIE_SECURE", cfg.TLSCertFile != "")
+	check(err)
+	cfg.TrustProxy, err = boolFromEnv("TRUST_PROXY", false)
+	check(err)
+	cfg.TrustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	check(err)
+
+	cfg.GitHubTimeout, err = durationFromEnv("GITHUB_TIMEOUT", 10*time.Second)
+	check(err)
+	cfg.OutboundTimeout, err = durationFromEnv("OUTBOUND_TIMEOUT", 30*time.Second)
+	check(err)
+	cfg.TokenRefreshWindow, err = durationFromEnv("TOKEN_REFRESH_WINDOW", 5*time.Minute)
+	check(err)
+
+	cfg.ReadTimeout, err = durationFromEnv("SERVER_READ_TIMEOUT", 15*time.Second)
+	check(err)
+	cfg.ReadHeaderTimeout, err = durationFromEnv("SERVER_READ_HEADER_TIMEOUT", 5*time.Second)
+	check(err)
+	cfg.WriteTimeout, err = durationFromEnv("SERVER_WRITE_TIMEOUT", 30*time.Second)
+	check(err)
+	cfg.IdleTimeout, err = durationFromEnv("SERVER_IDLE_TIMEOUT", 120*time.Second)
+	check(err)
+	// The callback makes the token exchange and user fetch into the provider
+	// within one GITHUB_TIMEOUT before it can respond.
+	if cfg.WriteTimeout > 0 && cfg.GitHubTimeout > 0 && cfg.WriteTimeout <= cfg.GitHubTimeout {
+		errs = append(errs, fmt.Errorf("SERVER_WRITE_TIMEOUT (%s) must be longer than GITHUB_TIMEOUT (%s)", cfg.WriteTimeout, cfg.GitHubTimeout))
+	}
+	cfg.SessionMaxAge, err = durationFromEnv("SESSION_MAX_AGE", 30*24*time.Hour)
+	check(err)
+	cfg.SessionIdleTimeout, err = durationFromEnv("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+	check(err)
+	cfg.RememberIdleTimeout, err = durationFromEnv("REMEMBER_IDLE_TIMEOUT", 7*24*time.Hour)
+	check(err)
+
+	maxBody, err := intFromEnv("MAX_REQUEST_BODY_BYTES", 64<<10)
+	check(err)
+	cfg.MaxRequestBodyBytes = int64(maxBody)
+	cfg.MaxConcurrentRequests, err = intFromEnv("MAX_CONCURRENT_REQUESTS", 0)
+	check(err)
+
+	cfg.ReposMaxPages, err = intFromEnv("REPOS_MAX_PAGES", 5)
+	check(err)
+	cfg.CacheTTL, err = durationFromEnv("CACHE_TTL", time.Minute)
+	check(err)
+	cfg.RateLimitPerMinute, err = intFromEnv("RATE_LIMIT_PER_MINUTE", 30)
+	check(err)
+	cfg.RateLimitBurst, err = intFromEnv("RATE_LIMIT_BURST", 10)
+	check(err)
+
+	if raw := os.Getenv("OUTBOUND_PROXY_URL"); raw != "" {
+		cfg.OutboundProxyURL, err = url.Parse(raw)
+		if err != nil || cfg.OutboundProxyURL.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid OUTBOUND_PROXY_URL %q: must be a URL such as http://proxy:3128", raw))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// githubURLs returns the GitHub Enterprise Server base URL, if any, and the
+// REST API base URL. GITHUB_API_URL defaults to https://api.github.com, or to
+// <GITHUB_BASE_URL>/api/v3 when a base URL is set.
+func githubURLs() (base, api string, err error) {
+	base = strings.TrimRight(os.Getenv("GITHUB_BASE_URL"), "/")
+	api = strings.TrimRight(os.Getenv("GITHUB_API_URL"), "/")
+
+	if base != "" {
+		if u, err := url.Parse(base); err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", "", fmt.Errorf("invalid GITHUB_BASE_URL %q: must be an https URL such as https://github.example.com", base)
+		}
+	}
+
+	switch {
+	case api != "":
+		if u, err := url.Parse(api); err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", "", fmt.Errorf("invalid GITHUB_API_URL %q: must be an https URL such as https://github.example.com/api/v3", api)
+		}
+	case base != "":
+		api = base + "/api/v3"
+	default:
+		api = defaultGitHubAPIURL
+	}
+	return base, api, nil
+}
+
+// loadDotEnv sets variables from path if the file exists. Variables already
+// in the environment take precedence over the file.
+func loadDotEnv(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		slog.Info("No .env file found, using system environment variables")
+		return nil
+	}
+	if err := godotenv.Load(path); err != nil {
+		return fmt.Errorf("load %s: %w", path, err)
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	slog.Info("Loaded environment file", "file", path)
+	return nil
+}
+
+// secretFromEnv returns the value of key or, when it is unset, the contents
+// of the file named by key_FILE with trailing newlines trimmed. This lets
+// secrets be mounted as files instead of exposed in the environment.
+func secretFromEnv(key string) (string, error) {
+	if v := os.Getenv(key); v != "" {
+		return v, nil
+	}
+
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func validCookieName(name string) bool {
+	return name != "" && tokenChars(name)
+}
+
+// tokenChars reports whether v contains only letters, digits, '-', '_' and
+// '.', which are safe in cookie names, headers and log output.
+func tokenChars(v string) bool {
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func tlsFiles() (cert, key string, err error) {
+	cert, key = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if cert == "" && key == "" {
+		return "", "", nil
+	}
+	if cert == "" || key == "" {
+		return "", "", errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	for _, path := range []string{cert, key} {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", "", fmt.Errorf("TLS file not readable: %w", err)
+		}
+		f.Close()
+	}
+	return cert, key, nil
+}
+
+func listenAddr() (string, error) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q: must be an integer between 1 and 65535", port)
+	}
+
+	return net.JoinHostPort(os.Getenv("BIND_ADDR"), port), nil
+}
+
+// cookieDomain validates COOKIE_DOMAIN, dropping the leading dot browsers
+// ignore anyway. The callback must be served from within the domain or the
+// session set there is never sent back, so a mismatch is logged.
+func cookieDomain(raw, redirectURL string) (string, error) {
+	domain := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(raw)), ".")
+	if domain == "" {
+		return "", nil
+	}
+
+	labels := strings.Split(domain, ".")
+	valid := len(labels) >= 2
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' ||
+			strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			valid = false
+		}
+	}
+	if !valid || net.ParseIP(domain) != nil {
+		return "", fmt.Errorf("invalid COOKIE_DOMAIN %q: must be a domain name such as example.com", raw)
+	}
+
+	if u, err := url.Parse(redirectURL); err == nil {
+		if host := strings.ToLower(u.Hostname()); host != domain && !strings.HasSuffix(host, "."+domain) {
+			slog.Warn("COOKIE_DOMAIN does not cover the GITHUB_REDIRECT_URL host, sessions will not persist across the login", "cookie_domain", domain, "redirect_host", host)
+		}
+	}
+	return domain, nil
+}
+
+// basePath normalizes BASE_PATH to a leading slash and no trailing slash, so
+// "auth", "/auth" and "/auth/" all mount the app under /auth. Backslashes
+// are refused: browsers read a redirect to /\evil.com as //evil.com.
+func basePath(raw string) (string, error) {
+	p := strings.Trim(strings.TrimSpace(raw), "/")
+	if p == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse("/" + p)
+	if err != nil || u.Path != "/"+p || u.RawQuery != "" || path.Clean(u.Path) != u.Path || strings.Contains(p, `\`) {
+		return "", fmt.Errorf("invalid BASE_PATH %q: must be a plain path such as /auth", raw)
+	}
+	return "/" + p, nil
+}
+
+func parseScopes(raw string) []string {
+	scopes := splitList(raw)
+	if len(scopes) == 0 {
+		return []string{"user:email"}
+	}
+	return scopes
+}
+
+// splitList splits a comma-separated value, trimming spaces and dropping
+// empty entries.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration such as 10s", key, raw)
+	}
+	return d, nil
+}
+
+func intFromEnv(key string, def int) (int, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", key, raw)
+	}
+	return n, nil
+}
+
+func boolFromEnv(key string, def bool) (bool, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", key, raw)
+	}
+	return b, nil
+}
+
+func validateRedirectURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("invalid GITHUB_REDIRECT_URL %q: must be an absolute URL such as http://localhost:8080/callback", raw)
+	}
+	return nil
+}
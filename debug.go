@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// debugSessionHandler dumps the decoded session as JSON in DEV mode. Tokens,
+// OAuth state and CSRF values are redacted; anywhere else it is a 404.
+func (s *Server) debugSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.Dev {
+		http.NotFound(w, r)
+		return
+	}
+
+	session := s.session(w, r)
+	values := make(map[string]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		key := fmt.Sprint(k)
+		values[key] = redactSessionValue(key, v)
+	}
+
+	s.writeJSON(w, r, http.StatusOK, struct {
+		Name   string                 `json:"name"`
+		IsNew  bool                   `json:"is_new"`
+		MaxAge int                    `json:"max_age"`
+		Values map[string]interface{} `json:"values"`
+	}{
+		Name:   session.Name(),
+		IsNew:  session.IsNew,
+		MaxAge: session.Options.MaxAge,
+		Values: values,
+	})
+}
+
+func redactSessionValue(key string, v interface{}) interface{} {
+	if t, ok := v.(*StoredToken); ok {
+		return map[string]interface{}{
+			"access_token":  redacted,
+			"refresh_token": redactIfSet(t.RefreshToken),
+			"token_type":    t.TokenType,
+			"expiry":        t.Expiry,
+		}
+	}
+
+	lower := strings.ToLower(key)
+	if strings.Contains(lower, "token") || strings.Contains(lower, "state") || strings.Contains(lower, "secret") {
+		return redacted
+	}
+	return v
+}
+
+func redactIfSet(v string) string {
+	if v == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/oauth2"
+)
+
+// newHTTPClient builds the client used for every outbound OAuth and API
+// request. OUTBOUND_PROXY_URL overrides the standard HTTPS_PROXY handling,
+// OUTBOUND_CA_FILE adds a PEM bundle to the system roots, and
+// OUTBOUND_TIMEOUT bounds each request. Every request carries USER_AGENT,
+// which GitHub requires; token-carrying oauth2 clients inherit it through
+// oauthContext.
+func newHTTPClient(cfg *Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.OutboundProxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.OutboundProxyURL)
+	}
+
+	if caFile := cfg.OutboundCAFile; caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read OUTBOUND_CA_FILE: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("OUTBOUND_CA_FILE %q contains no valid PEM certificates", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	// Through a proxy the dialed address is the proxy's, which may well be
+	// internal, so safeFetch's dial-time check only applies without one.
+	var base http.RoundTripper = transport
+	if cfg.OutboundProxyURL == nil && os.Getenv("HTTPS_PROXY") == "" && os.Getenv("https_proxy") == "" {
+		base = newInternalGuard(transport)
+	}
+
+	return &http.Client{
+		Transport: &userAgentTransport{base: base, userAgent: cfg.UserAgent},
+		Timeout:   cfg.OutboundTimeout,
+	}, nil
+}
+
+// userAgentTransport sets User-Agent on requests that don't have one.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// oauthContext attaches the outbound client to ctx so the oauth2 package uses
+// it for token exchange, refresh, and as the base transport of authenticated
+// clients.
+func (s *Server) oauthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, s.httpClient)
+}
+
+// apiClient returns a client that calls provider's API with token. It
+// shares the outbound client's transport, so proxy, CA and USER_AGENT
+// settings apply, and its OUTBOUND_TIMEOUT, which oauth2.Config.Client
+// alone does not carry over. Every authenticated API call goes through it.
+func (s *Server) apiClient(ctx context.Context, provider Provider, token *oauth2.Token) *http.Client {
+	client := provider.Config().Client(s.oauthContext(ctx), token)
+	client.Timeout = s.httpClient.Timeout
+	return client
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUserAgentTransport(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	client, err := newHTTPClient(&Config{UserAgent: "test-agent/1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "test-agent/1.0" {
+		t.Errorf("User-Agent = %q, want test-agent/1.0", got)
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		t.Errorf("caller's request modified: User-Agent %q", ua)
+	}
+
+	// A caller's own User-Agent is left alone.
+	req.Header.Set("User-Agent", "custom")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "custom" {
+		t.Errorf("User-Agent = %q, want custom", got)
+	}
+}
+
+// GitHub rejects API requests without a User-Agent, so every outbound
+// request of a login, including the token exchange and the calls made
+// with the user's token, must carry USER_AGENT.
+func TestLoginRequestsCarryUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	agents := map[string]string{}
+	record := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			agents[r.URL.Path] = r.Header.Get("User-Agent")
+			mu.Unlock()
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	gh := newFakeGitHub(t, nil)
+	gh.Config.Handler = record(gh.Config.Handler)
+	s := newTestServer(t, gh, "USER_AGENT=login-test/2.0")
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	login(t, c, app.URL, "")
+	_, page := get(t, c, app.URL+"/profile")
+	postForm(t, c, app.URL+"/logout", map[string][]string{"csrf_token": {csrfToken(t, page)}})
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/login/oauth/access_token", "/api/v3/user", "/api/v3/user/emails", "/api/v3/applications/test-client/token"} {
+		agent, ok := agents[path]
+		if !ok {
+			t.Errorf("no request to %s", path)
+			continue
+		}
+		if !strings.HasPrefix(agent, "login-test/2.0") {
+			t.Errorf("%s: User-Agent %q, want login-test/2.0", path, agent)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLang = "en"
+
+// messages is the catalog of user-facing template strings. Entries taking
+// arguments are fmt formats, used as {{printf (T .Lang "key") arg}}. English
+// is complete; other languages fall back to it for missing keys.
+var messages = map[string]map[string]string{
+	"en": {
+		"app.title":                "GitHub OAuth Example",
+		"nav.home":                 "Home",
+		"nav.back_home":            "Back to home",
+		"nav.profile":              "Profile",
+		"nav.cancel":               "Cancel",
+		"home.heading":             "GitHub OAuth Login Example",
+		"home.welcome":             "Welcome back, %s!",
+		"home.view_profile":        "View Profile",
+		"home.logout":              "Logout",
+		"home.account_deleted":     "Your data has been deleted and you have been signed out.",
+		"home.please_login":        "Please log in with your GitHub account to continue.",
+		"home.login_with":          "Login with %s",
+		"home.remember":            "Remember me",
+		"profile.title":            "Profile",
+		"profile.heading":          "Your GitHub Profile",
+		"profile.avatar":           "Avatar",
+		"profile.username":         "Username:",
+		"profile.name":             "Name:",
+		"profile.email":            "Email:",
+		"profile.public_repos":     "Public repos:",
+		"profile.followers":        "Followers:",
+		"profile.repositories":     "Repositories",
+		"profile.refresh":          "Refresh profile",
+		"profile.clear":            "Clear profile data",
+		"profile.logout_all":       "Log out everywhere",
+		"profile.delete":           "Delete my data",
+		"profile.missing_scopes":   "You did not grant every permission this app asks for (%s), so some pages may not work.",
+		"profile.grant_access":     "Grant access",
+		"repos.title":              "Repositories",
+		"repos.heading":            "%s's Repositories",
+		"repos.none":               "No repositories found.",
+		"repos.public_only":        "Only public repositories are shown.",
+		"repos.grant_private":      "Grant access to private repositories",
+		"logout_all.title":         "Log out everywhere",
+		"logout_all.heading":       "Log out everywhere?",
+		"logout_all.body":          "This signs you out of every browser and device currently logged in to this app, including this one.",
+		"logout_all.submit":        "Log out everywhere",
+		"logged_out.title":         "Logged out",
+		"logged_out.heading":       "You have been logged out",
+		"logged_out.provider":      "This only ended your session in this app. You are probably still signed in to %s, so logging in here again may not ask for your password.",
+		"logged_out.generic":       "This only ended your session in this app, not with the login provider.",
+		"logged_out.github_logout": "Sign out of GitHub",
+		"account_delete.title":     "Delete account data",
+		"account_delete.heading":   "Delete your data?",
+		"account_delete.body":      "This revokes the app's access to your account, removes everything the app has stored about you and signs you out on every device. Your account with the provider itself is not affected.",
+		"account_delete.submit":    "Delete my data",
+		"rate_limited.title":       "Rate limited",
+		"rate_limited.heading":     "Too many requests",
+		"rate_limited.body":        "GitHub is temporarily rate limiting this application.",
+		"rate_limited.retry":       "Please try again in about %s (after %s).",
+		"sso.title":                "Organization authorization required",
+		"sso.heading":              "Authorize this app for your organization",
+		"sso.body":                 "An organization you belong to uses SAML single sign-on, and your login has not been authorized for it yet. Authorize it on GitHub, then try again.",
+		"sso.authorize":            "Authorize on GitHub",
+		"error.request_id":         "Request ID:",
+		"error.try_again":          "Try again",
+		"theme.label":              "Theme:",
+		"theme.light":              "Light",
+		"theme.dark":               "Dark",
+		"theme.auto":               "System",
+	},
+	"ja": {
+		"app.title":                "GitHub OAuth サンプル",
+		"nav.home":                 "ホーム",
+		"nav.back_home":            "ホームに戻る",
+		"nav.profile":              "プロフィール",
+		"nav.cancel":               "キャンセル",
+		"home.heading":             "GitHub OAuth ログインのサンプル",
+		"home.welcome":             "おかえりなさい、%sさん!",
+		"home.view_profile":        "プロフィールを見る",
+		"home.logout":              "ログアウト",
+		"home.account_deleted":     "データを削除し、ログアウトしました。",
+		"home.please_login":        "続けるには GitHub アカウントでログインしてください。",
+		"home.login_with":          "%s でログイン",
+		"home.remember":            "ログイン状態を保持する",
+		"profile.title":            "プロフィール",
+		"profile.heading":          "GitHub プロフィール",
+		"profile.avatar":           "アバター",
+		"profile.username":         "ユーザー名:",
+		"profile.name":             "名前:",
+		"profile.email":            "メール:",
+		"profile.public_repos":     "公開リポジトリ:",
+		"profile.followers":        "フォロワー:",
+		"profile.repositories":     "リポジトリ",
+		"profile.refresh":          "プロフィールを更新",
+		"profile.clear":            "プロフィール情報を消去",
+		"profile.logout_all":       "すべての端末からログアウト",
+		"profile.delete":           "データを削除",
+		"profile.missing_scopes":   "このアプリが求める権限の一部 (%s) が許可されていないため、一部のページが動作しない場合があります。",
+		"profile.grant_access":     "アクセスを許可する",
+		"repos.title":              "リポジトリ",
+		"repos.heading":            "%s のリポジトリ",
+		"repos.none":               "リポジトリが見つかりません。",
+		"repos.public_only":        "公開リポジトリのみ表示しています。",
+		"repos.grant_private":      "非公開リポジトリへのアクセスを許可する",
+		"logout_all.title":         "すべての端末からログアウト",
+		"logout_all.heading":       "すべての端末からログアウトしますか?",
+		"logout_all.body":          "この端末を含め、このアプリにログインしているすべてのブラウザと端末からログアウトします。",
+		"logout_all.submit":        "すべての端末からログアウト",
+		"logged_out.title":         "ログアウトしました",
+		"logged_out.heading":       "ログアウトしました",
+		"logged_out.provider":      "終了したのはこのアプリのセッションだけです。%s にはまだログインしているため、次回はパスワードを求められない場合があります。",
+		"logged_out.generic":       "終了したのはこのアプリのセッションだけで、ログインプロバイダーのセッションは続いています。",
+		"logged_out.github_logout": "GitHub からログアウト",
+		"account_delete.title":     "アカウントデータの削除",
+		"account_delete.heading":   "データを削除しますか?",
+		"account_delete.body":      "アカウントへのアクセス権を取り消し、このアプリが保存しているあなたの情報をすべて削除して、すべての端末からログアウトします。プロバイダーのアカウント自体には影響しません。",
+		"account_delete.submit":    "データを削除",
+		"rate_limited.title":       "リクエスト制限中",
+		"rate_limited.heading":     "リクエストが多すぎます",
+		"rate_limited.body":        "GitHub がこのアプリケーションのリクエストを一時的に制限しています。",
+		"rate_limited.retry":       "約 %s 後 (%s 以降) にもう一度お試しください。",
+		"sso.title":                "組織の承認が必要です",
+		"sso.heading":              "組織に対してこのアプリを承認してください",
+		"sso.body":                 "所属する組織が SAML シングルサインオンを使用しており、あなたのログインはまだその組織に承認されていません。GitHub で承認してから、もう一度お試しください。",
+		"sso.authorize":            "GitHub で承認する",
+		"error.request_id":         "リクエスト ID:",
+		"error.try_again":          "もう一度試す",
+		"theme.label":              "テーマ:",
+		"theme.light":              "ライト",
+		"theme.dark":               "ダーク",
+		"theme.auto":               "システム設定",
+	},
+}
+
+// translate is the template function T. Unknown languages and keys fall
+// back to English, and a key missing there too is shown as-is.
+func translate(lang, key string) string {
+	if msg, ok := messages[lang][key]; ok {
+		return msg
+	}
+	if msg, ok := messages[defaultLang][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// requestLang picks the supported language the client prefers most from
+// Accept-Language, matching "ja-JP" to "ja", or defaultLang.
+func requestLang(r *http.Request) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		base, _, _ := strings.Cut(tag, "-")
+		if _, ok := messages[base]; !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{base, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLang
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// maxJWTCookieLen matches the limit securecookie applies to the cookie store;
+// browsers drop cookies much larger than this.
+const maxJWTCookieLen = 4096
+
+var (
+	errJWTMalformed = errors.New("malformed session JWT")
+	errJWTSignature = errors.New("invalid session JWT signature")
+	errJWTExpired   = errors.New("session JWT has expired")
+)
+
+// jwtHeader is the only header this store issues or accepts, so a token
+// claiming another algorithm, including "none", never validates.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// jwtClaims is the payload of a session JWT. The user's identity is carried
+// as plain claims; every other session value (token, CSRF token, OAuth state
+// and so on) is gob-encoded into Values so it keeps its Go type, then
+// encrypted so the OAuth token is not readable from the cookie.
+type jwtClaims struct {
+	Subject   string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+
+	Provider  string `json:"provider,omitempty"`
+	Login     string `json:"login,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Email     string `json:"email,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	Values []byte `json:"ses,omitempty"`
+}
+
+// jwtStore is a sessions.Store that keeps the whole session in an HS256
+// JWT cookie signed with SESSION_SECRET, so replicas need nothing shared
+// but the secret. The identity claims are only signed; the rest of the
+// session is encrypted with a key derived from the secret.
+type jwtStore struct {
+	secrets [][]byte
+	Options *sessions.Options
+	// lifetime bounds tokens issued for browser-session cookies, which have
+	// no MaxAge of their own.
+	lifetime time.Duration
+}
+
+func newJWTStore(secrets [][]byte, opts *sessions.Options, lifetime time.Duration) *jwtStore {
+	return &jwtStore{secrets: secrets, Options: opts, lifetime: lifetime}
+}
+
+func (s *jwtStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session decoded from the request's cookie, or an empty
+// one together with the reason an existing cookie was rejected.
+func (s *jwtStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	claims, err := s.parse(c.Value, time.Now())
+	if err != nil {
+		return session, err
+	}
+	if claims.Values, err = openValues(s.secrets, claims.Values); err != nil {
+		return session, err
+	}
+	if err := claims.restore(session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *jwtStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	lifetime := s.lifetime
+	if session.Options.MaxAge > 0 {
+		lifetime = time.Duration(session.Options.MaxAge) * time.Second
+	}
+	claims, err := newJWTClaims(session.Values, now, lifetime)
+	if err != nil {
+		return err
+	}
+	if claims.Values, err = sealValues(s.secrets[0], claims.Values); err != nil {
+		return err
+	}
+	token, err := s.sign(claims)
+	if err != nil {
+		return err
+	}
+	if len(token) > maxJWTCookieLen {
+		return fmt.Errorf("session JWT is %d bytes, over the %d byte cookie limit", len(token), maxJWTCookieLen)
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), token, session.Options))
+	return nil
+}
+
+func (s *jwtStore) sign(claims *jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(s.secrets[0], signed)), nil
+}
+
+// parse checks the token's header, signature and expiry before decoding
+// its claims.
+func (s *jwtStore) parse(token string, now time.Time) (*jwtClaims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return nil, errJWTMalformed
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, errJWTMalformed
+	}
+
+	gotMAC, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	if !validMAC(s.secrets, header+"."+payload, gotMAC) {
+		return nil, errJWTSignature
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errJWTExpired
+	}
+	return &claims, nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// validMAC reports whether mac signs msg under any of secrets, so values
+// signed before a SESSION_SECRET rotation still verify.
+func validMAC(secrets [][]byte, msg string, mac []byte) bool {
+	for _, secret := range secrets {
+		if hmac.Equal(mac, hmacSHA256(secret, msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sealValues encrypts the gob-encoded session values with AES-GCM under
+// secret's encryption key, prefixing the random nonce.
+func sealValues(secret, plain []byte) ([]byte, error) {
+	if len(plain) == 0 {
+		return nil, nil
+	}
+	aead, err := newValuesAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// openValues reverses sealValues, trying each secret's key so values
+// sealed before a rotation still decrypt.
+func openValues(secrets [][]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, nil
+	}
+	for _, secret := range secrets {
+		aead, err := newValuesAEAD(secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < aead.NonceSize() {
+			break
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: session values do not decrypt", errJWTMalformed)
+}
+
+func newValuesAEAD(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey(secret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// jwtIdentityKeys are the session values carried as named claims rather
+// than inside the gob-encoded remainder.
+var jwtIdentityKeys = []string{keyProvider, keyID, keyUser, keyName, keyEmail, keyAvatarURL}
+
+func newJWTClaims(values map[interface{}]interface{}, now time.Time, lifetime time.Duration) (*jwtClaims, error) {
+	str := func(key string) string {
+		v, _ := values[key].(string)
+		return v
+	}
+	claims := &jwtClaims{
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		Provider:  str(keyProvider),
+		Login:     str(keyUser),
+		Name:      str(keyName),
+		Email:     str(keyEmail),
+		AvatarURL: str(keyAvatarURL),
+	}
+	if id := str(keyID); id != "" {
+		claims.Subject = userKey(claims.Provider, id)
+	}
+
+	rest := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		rest[k] = v
+	}
+	for _, k := range jwtIdentityKeys {
+		delete(rest, k)
+	}
+	if len(rest) > 0 {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(rest); err != nil {
+			return nil, fmt.Errorf("encode session values: %w", err)
+		}
+		claims.Values = buf.Bytes()
+	}
+	return claims, nil
+}
+
+// restore writes the claims back into a session's values.
+func (c *jwtClaims) restore(values map[interface{}]interface{}) error {
+	if len(c.Values) > 0 {
+		var rest map[interface{}]interface{}
+		if err := gob.NewDecoder(bytes.NewReader(c.Values)).Decode(&rest); err != nil {
+			return fmt.Errorf("%w: decode session values: %v", errJWTMalformed, err)
+		}
+		for k, v := range rest {
+			values[k] = v
+		}
+	}
+
+	set := func(key, v string) {
+		if v != "" {
+			values[key] = v
+		}
+	}
+	set(keyProvider, c.Provider)
+	set(keyUser, c.Login)
+	set(keyName, c.Name)
+	set(keyEmail, c.Email)
+	set(keyAvatarURL, c.AvatarURL)
+	if _, id, ok := strings.Cut(c.Subject, ":"); ok {
+		set(keyID, id)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeJWTClaims returns a session JWT's claims without checking them.
+func decodeJWTClaims(t *testing.T, token string) jwtClaims {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts, want 3", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestJWTStoreEncryptsValues(t *testing.T) {
+	const accessToken = "gho_secretaccesstoken"
+	store := newJWTStore([][]byte{[]byte(testSessionSecret)}, testSessionOptions(), time.Hour)
+	_, token := roundTrip(t, store, map[interface{}]interface{}{
+		keyUser:  "octocat",
+		keyToken: &StoredToken{AccessToken: accessToken, TokenType: "bearer"},
+	})
+
+	claims := decodeJWTClaims(t, token)
+	if claims.Login != "octocat" {
+		t.Errorf("login claim = %q, want octocat", claims.Login)
+	}
+	if len(claims.Values) == 0 {
+		t.Fatal("ses claim is empty")
+	}
+	if bytes.Contains(claims.Values, []byte(accessToken)) {
+		t.Fatal("access token is readable in the ses claim")
+	}
+}
+
+// Values other than the identity claims travel in the gob-encoded ses
+// claim and must come back with their Go types.
+func TestJWTClaimsValuesKeepTypes(t *testing.T) {
+	now := time.Now()
+	values := map[interface{}]interface{}{
+		keyUser:        "octocat",
+		keyID:          "42",
+		keyProvider:    "github",
+		keyToken:       &StoredToken{AccessToken: "gho_access", Expiry: now.Add(time.Hour).UTC()},
+		keyLastSeen:    now.Unix(),
+		keyRemember:    true,
+		keyPublicRepos: 7,
+		keyScopes:      []string{"read:user"},
+	}
+	claims, err := newJWTClaims(values, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "github:42" {
+		t.Errorf("sub = %q, want github:42", claims.Subject)
+	}
+
+	restored := map[interface{}]interface{}{}
+	if err := claims.restore(restored); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range values {
+		got := restored[k]
+		switch want := want.(type) {
+		case *StoredToken:
+			if got, ok := got.(*StoredToken); !ok || *got != *want {
+				t.Errorf("%v = %#v, want %#v", k, got, want)
+			}
+		case []string:
+			if got, ok := got.([]string); !ok || strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%v = %#v, want %#v", k, got, want)
+			}
+		default:
+			if got != want {
+				t.Errorf("%v = %#v (%T), want %#v (%T)", k, got, got, want, want)
+			}
+		}
+	}
+}
+
+func TestJWTStoreParseRejects(t *testing.T) {
+	store := newJWTStore([][]byte{[]byte(testSessionSecret)}, testSessionOptions(), time.Hour)
+	now := time.Now()
+	valid, err := store.sign(&jwtClaims{Subject: "github:42", Login: "octocat", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rest, _ := strings.Cut(valid, ".")
+	payload, sig, _ := strings.Cut(rest, ".")
+
+	// resign signs header.payload with the store's own key, so the header
+	// and payload checks are reached past a valid signature.
+	resign := func(header, payload string) string {
+		signed := header + "." + payload
+		return signed + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256([]byte(testSessionSecret), signed))
+	}
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tampered := encode(`{"sub":"github:1","login":"admin","iat":0,"exp":` + strconv.FormatInt(now.Add(time.Hour).Unix(), 10) + `}`)
+	expired, err := store.sign(&jwtClaims{Subject: "github:42", IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"tampered payload, original signature", header + "." + tampered + "." + sig, errJWTSignature},
+		{"signature stripped", header + "." + payload + ".", errJWTSignature},
+		{"signed with another key", header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256([]byte("another-secret-of-at-least-32-bytes"), header+"."+payload)), errJWTSignature},
+		{"alg none", encode(`{"alg":"none","typ":"JWT"}`) + "." + payload + ".", errJWTMalformed},
+		{"alg HS512", resign(encode(`{"alg":"HS512","typ":"JWT"}`), payload), errJWTMalformed},
+		{"alg RS256", encode(`{"alg":"RS256","typ":"JWT"}`) + "." + payload + "." + sig, errJWTMalformed},
+		{"two parts", header + "." + payload, errJWTMalformed},
+		{"signature not base64", header + "." + payload + ".!!!", errJWTMalformed},
+		{"signed payload not JSON", resign(header, encode("not json")), errJWTMalformed},
+		{"exp in the past", expired, errJWTExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := store.parse(tt.token, now); !errors.Is(err, tt.want) {
+				t.Errorf("parse error = %v, want %v", err, tt.want)
+			}
+			// The store reports the same error and an empty session.
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "session", Value: tt.token})
+			session, err := store.New(req, "session")
+			if !errors.Is(err, tt.want) || !session.IsNew || len(session.Values) != 0 {
+				t.Errorf("New = %v, %v, want an empty session and %v", session.Values, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := store.parse(valid, now.Add(2*time.Hour)); !errors.Is(err, errJWTExpired) {
+		t.Errorf("parse after exp: error = %v, want %v", err, errJWTExpired)
+	}
+	if _, err := store.parse(valid, now); err != nil {
+		t.Errorf("parse of a valid token: %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+// testUser is the account the fake GitHub logs every visitor in as.
+const testUser = `{"id":42,"login":"octocat","name":"The Octocat","avatar_url":"https://avatars.githubusercontent.com/u/42"}`
+
+// newFakeGitHub starts a GitHub Enterprise Server stand-in. It issues a
+// token on the OAuth token endpoint and passes /api/v3 requests, with the
+// prefix stripped, to api. A nil api serves githubAPI(testUser).
+func newFakeGitHub(t *testing.T, api http.Handler) *httptest.Server {
+	t.Helper()
+	if api == nil {
+		api = githubAPI(testUser)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("code") == "" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "gho_test",
+			"token_type":   "bearer",
+			"scope":        "read:user,user:email",
+		})
+	})
+	mux.Handle("/api/v3/", http.StripPrefix("/api/v3", api))
+
+	gh := httptest.NewTLSServer(mux)
+	t.Cleanup(gh.Close)
+	return gh
+}
+
+// githubAPI serves user as GET /user, no emails, and accepts token
+// revocation.
+func githubAPI(user string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, user)
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[]`)
+	})
+	mux.HandleFunc("/applications/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// newTestServer configures a Server against gh from the environment, as
+// main does, with env ("KEY=value") applied on top of the defaults. gh's
+// certificate is trusted through OUTBOUND_CA_FILE so the real outbound
+// client is used.
+func newTestServer(t *testing.T, gh *httptest.Server, env ...string) *Server {
+	t.Helper()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: gh.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := []string{
+		"GITHUB_CLIENT_ID=test-client",
+		"GITHUB_CLIENT_SECRET=test-secret",
+		"SESSION_SECRET=" + testSessionSecret,
+		"GITHUB_BASE_URL=" + gh.URL,
+		"OUTBOUND_CA_FILE=" + caFile,
+	}
+	for _, kv := range append(defaults, env...) {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newBrowser returns a client that keeps cookies and does not follow
+// redirects, so each hop of a flow can be checked.
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// get fetches url with c and returns the response with its body read.
+func get(t *testing.T, c *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readBody(t, resp)
+}
+
+// postForm posts form to url with c and returns the response with its body
+// read.
+func postForm(t *testing.T, c *http.Client, url string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	resp, err := c.PostForm(url, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, readBody(t, resp)
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// login runs the OAuth flow from base+"/login"+query through the callback
+// and returns the callback's response. base is the app's URL including any
+// mount prefix.
+func login(t *testing.T, c *http.Client, base, query string) *http.Response {
+	t.Helper()
+
+	resp, _ := get(t, c, base+"/login"+query)
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /login%s: status %d, want %d", query, resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ = get(t, c, base+"/callback?code=test-code&state="+url.QueryEscape(authURL.Query().Get("state")))
+	return resp
+}
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// csrfToken returns the first CSRF token in a rendered page.
+func csrfToken(t *testing.T, page string) string {
+	t.Helper()
+	m := csrfField.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatal("no csrf_token field on page")
+	}
+	return m[1]
+}
+
+func TestLoginFlow(t *testing.T) {
+	gh := newFakeGitHub(t, nil)
+	s := newTestServer(t, gh)
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	resp, _ := get(t, c, app.URL+"/login")
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /login: status %d, want %d", resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := authURL.Scheme+"://"+authURL.Host+authURL.Path, gh.URL+"/login/oauth/authorize"; got != want {
+		t.Fatalf("authorize URL = %s, want %s", got, want)
+	}
+	if got := authURL.Query().Get("client_id"); got != "test-client" {
+		t.Errorf("client_id = %q, want test-client", got)
+	}
+
+	resp, _ = get(t, c, app.URL+"/callback?code=test-code&state="+url.QueryEscape(authURL.Query().Get("state")))
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/profile" {
+		t.Fatalf("GET /callback: status %d, Location %q, want %d to /profile",
+			resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+
+	resp, page := get(t, c, app.URL+"/profile")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /profile: status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(page, "octocat") {
+		t.Error("profile page does not show the logged-in user")
+	}
+
+	resp, _ = postForm(t, c, app.URL+"/logout", url.Values{"csrf_token": {csrfToken(t, page)}})
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasPrefix(resp.Header.Get("Location"), "/logged-out") {
+		t.Fatalf("POST /logout: status %d, Location %q, want %d to /logged-out",
+			resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+
+	resp, _ = get(t, c, app.URL+"/profile")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("GET /profile after logout: status %d, Location %q, want %d to /",
+			resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+}
+
+func TestCallbackRejectsReplayedState(t *testing.T) {
+	gh := newFakeGitHub(t, nil)
+	s := newTestServer(t, gh)
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+
+	tests := []struct {
+		name string
+		// keep returns the cookies replayed with the callback URL, from
+		// the browser's cookies right after /login.
+		keep func(session, state *http.Cookie) []*http.Cookie
+	}{
+		{"session and state cookie", func(session, state *http.Cookie) []*http.Cookie {
+			return []*http.Cookie{session, state}
+		}},
+		{"state cookie only", func(_, state *http.Cookie) []*http.Cookie {
+			return []*http.Cookie{state}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newBrowser(t)
+			resp, _ := get(t, c, app.URL+"/login")
+			authURL, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var session, state *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				switch cookie.Name {
+				case s.cfg.SessionName:
+					session = cookie
+				case s.stateCookieName():
+					state = cookie
+				}
+			}
+			if session == nil || state == nil {
+				t.Fatal("/login did not set both the session and the state cookie")
+			}
+			callback := app.URL + "/callback?code=test-code&state=" + url.QueryEscape(authURL.Query().Get("state"))
+
+			// An attacker holding a copy of the cookies replays the callback
+			// after the real one went through.
+			if resp, _ := get(t, c, callback); resp.StatusCode != http.StatusSeeOther {
+				t.Fatalf("first callback: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+			}
+			req, err := http.NewRequest(http.MethodGet, callback, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cookie := range tt.keep(session, state) {
+				req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+			}
+			resp, err = newBrowser(t).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("replayed callback: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	redis := newFakeRedis(t)
+	tests := []struct {
+		backend    string
+		env        []string
+		wantRevoke bool
+	}{
+		{"cookie", nil, false},
+		{"jwt", []string{"SESSION_BACKEND=jwt"}, false},
+		{"redis", []string{"SESSION_BACKEND=redis", "REDIS_URL=" + redis.URL()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			s := newTestServer(t, newFakeGitHub(t, nil), tt.env...)
+			app := httptest.NewServer(s.routes())
+			defer app.Close()
+			laptop, phone := newBrowser(t), newBrowser(t)
+			login(t, laptop, app.URL, "")
+			login(t, phone, app.URL, "")
+
+			_, profile := get(t, laptop, app.URL+"/profile")
+			if got := strings.Contains(profile, `/logout/all"`); got != tt.wantRevoke {
+				t.Errorf("profile links to /logout/all: %v, want %v", got, tt.wantRevoke)
+			}
+
+			resp, page := get(t, laptop, app.URL+"/logout/all")
+			if !tt.wantRevoke {
+				if resp.StatusCode != http.StatusNotImplemented {
+					t.Fatalf("GET /logout/all: status %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+				}
+				resp, _ = postForm(t, laptop, app.URL+"/logout/all", url.Values{"csrf_token": {csrfToken(t, profile)}})
+				if resp.StatusCode != http.StatusNotImplemented {
+					t.Fatalf("POST /logout/all: status %d, want %d", resp.StatusCode, http.StatusNotImplemented)
+				}
+				return
+			}
+
+			resp, _ = postForm(t, laptop, app.URL+"/logout/all", url.Values{"csrf_token": {csrfToken(t, page)}})
+			if resp.StatusCode != http.StatusSeeOther {
+				t.Fatalf("POST /logout/all: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+			}
+			if resp, _ := get(t, phone, app.URL+"/profile"); resp.StatusCode != http.StatusSeeOther {
+				t.Fatalf("GET /profile on the other device: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+			}
+
+			// A later login starts at the new generation and is valid.
+			login(t, phone, app.URL, "")
+			if resp, _ := get(t, phone, app.URL+"/profile"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /profile after logging in again: status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/profile", "/profile"},
+		{"/repos?page=2#top", "/repos?page=2#top"},
+		{"/a//b", "/a//b"},
+		{"/%7Euser", "/%7Euser"},
+		{"", "/fallback"},
+		{"profile", "/fallback"},
+		{"https://evil.com", "/fallback"},
+		{"https://evil.com/profile", "/fallback"},
+		{"javascript:alert(1)", "/fallback"},
+		{"//evil.com", "/fallback"},
+		{"///evil.com", "/fallback"},
+		{"/\\evil.com", "/fallback"},
+		{"/\\/evil.com", "/fallback"},
+		{"/%5Cevil.com", "/fallback"},
+		{"/%5cevil.com", "/fallback"},
+		{"/%2F%2Fevil.com", "/fallback"},
+		{"/\tevil.com", "/fallback"},
+		{"/\n/evil.com", "/fallback"},
+		{"/%0d%0aSet-Cookie:x", "/fallback"},
+		{"/\x7fevil.com", "/fallback"},
+	}
+	for _, tt := range tests {
+		if got := safeRedirect(tt.target, "/fallback"); got != tt.want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestProfileClearKeepsLogin(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil))
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+	login(t, c, app.URL, "")
+
+	_, page := get(t, c, app.URL+"/profile")
+	if !strings.Contains(page, "The Octocat") {
+		t.Fatal("profile page does not show the name before clearing")
+	}
+	resp, _ := postForm(t, c, app.URL+"/profile/clear", url.Values{"csrf_token": {csrfToken(t, page)}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("POST /profile/clear: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+
+	resp, page = get(t, c, app.URL+"/profile")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /profile after clearing: status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(page, "octocat") || strings.Contains(page, "The Octocat") {
+		t.Error("profile after clearing should show the login but not the name")
+	}
+}
+
+// A session cookie obtained before login, possibly planted in the victim's
+// browser, must not be logged in by the callback.
+func TestLoginRenewsSession(t *testing.T) {
+	redis := newFakeRedis(t)
+	tests := []struct {
+		backend string
+		env     []string
+	}{
+		{"cookie", nil},
+		{"jwt", []string{"SESSION_BACKEND=jwt"}},
+		{"redis", []string{"SESSION_BACKEND=redis", "REDIS_URL=" + redis.URL()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			s := newTestServer(t, newFakeGitHub(t, nil), tt.env...)
+			app := httptest.NewServer(s.routes())
+			defer app.Close()
+			appURL, err := url.Parse(app.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, _ := get(t, newBrowser(t), app.URL+"/login")
+			var sessionCookie *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				if cookie.Name == s.cfg.SessionName {
+					sessionCookie = cookie
+				}
+			}
+			if sessionCookie == nil {
+				t.Fatal("no session cookie before login")
+			}
+
+			victim := newBrowser(t)
+			victim.Jar.SetCookies(appURL, []*http.Cookie{sessionCookie})
+			if resp := login(t, victim, app.URL, ""); resp.StatusCode != http.StatusSeeOther {
+				t.Fatalf("callback: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+			}
+			if resp, _ := get(t, victim, app.URL+"/api/me"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /api/me as the victim: status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, app.URL+"/api/me", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(&http.Cookie{Name: sessionCookie.Name, Value: sessionCookie.Value})
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := readBody(t, resp); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET /api/me with the pre-login cookie: status %d, body %s, want %d", resp.StatusCode, body, http.StatusUnauthorized)
+			}
+		})
+	}
+}
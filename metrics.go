@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests by handler and status code.",
+		},
+		[]string{"handler", "status"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by handler.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler"},
+	)
+	oauthExchangeFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "oauth_exchange_failures_total",
+			Help: "Number of failed OAuth code-for-token exchanges.",
+		},
+	)
+	sessionDecodeFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "session_decode_failures_total",
+			Help: "Number of session cookies rejected as invalid, expired or tampered with.",
+		},
+	)
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Number of cache lookups by cache and result (hit or miss).",
+		},
+		[]string{"cache", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, oauthExchangeFailures, sessionDecodeFailures, cacheRequests)
+}
+
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorderFor(w)
+
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		mux.ServeHTTP(rec, r)
+
+		httpRequestsTotal.WithLabelValues(pattern, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(pattern).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// recorderFor reuses an outer statusRecorder when one is already in place so
+// that stacked middleware observe the same status without wrapping twice.
+func recorderFor(w http.ResponseWriter) *statusRecorder {
+	if rec, ok := w.(*statusRecorder); ok {
+		return rec
+	}
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// chain wraps h in mws so that the first middleware is the outermost, i.e.
+// chain(h, a, b) is a(b(h)).
+func chain(h http.Handler, mws ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorderFor(w)
+
+		next.ServeHTTP(rec, r)
+
+		s.log(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"ip", s.clientIP(r),
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// allowMethods wraps next so that requests with any other method get 405
+// Method Not Allowed and an Allow header.
+func (s *Server) allowMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.checkMethod(w, r, methods...) {
+			next(w, r)
+		}
+	}
+}
+
+// checkMethod reports whether r uses one of methods, otherwise writing the
+// 405 response. GET also permits HEAD, as net/http does.
+func (s *Server) checkMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) || (r.Method == http.MethodHead && slices.Contains(methods, http.MethodGet)) {
+		return true
+	}
+
+	allow := methods
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		allow = append(slices.Clip(methods), http.MethodHead)
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	s.renderError(w, r, http.StatusMethodNotAllowed, "Method not allowed", "This page does not accept "+r.Method+" requests.")
+	return false
+}
+
+// parseForms caps request bodies at MAX_REQUEST_BODY_BYTES and parses the
+// query and any urlencoded form up front, so handlers can use FormValue
+// knowing a malformed or oversized request has already been answered with
+// 400 or 413 rather than silently read as empty.
+func (s *Server) parseForms(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxRequestBodyBytes)
+		if err := r.ParseForm(); err != nil {
+			s.log(r).Info("Rejected request form", "path", r.URL.Path, "error", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				s.renderError(w, r, http.StatusRequestEntityTooLarge, "Request too large", "The request body is larger than this app accepts.")
+				return
+			}
+			s.renderError(w, r, http.StatusBadRequest, "Invalid request", "The request could not be read, please try again.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanics turns a panicking handler into a logged error and a 500 page
+// instead of a dropped connection. http.ErrAbortHandler is re-raised so
+// net/http can abort the response as intended.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			s.log(r).Error("Handler panic", "path", r.URL.Path, "error", err, "stack", string(debug.Stack()))
+			s.renderError(w, r, http.StatusInternalServerError, "Something went wrong", "An unexpected error occurred, please try again later.")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"img-src 'self' https://avatars.githubusercontent.com https://secure.gravatar.com https://gitlab.com https://*.googleusercontent.com; " +
+	"style-src 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"base-uri 'none'"
+
+func securityHeaders(csp string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Content-Security-Policy", csp)
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			h.Set("X-Frame-Options", "DENY")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := s.session(w, r)
+		// The user ID keys the repository cache and session generation, so
+		// a session without one, such as one written before IDs were stored,
+		// must log in again rather than share the "provider:" key.
+		authenticated := getStringFromSession(session, keyUser) != "" && getStringFromSession(session, keyID) != ""
+		if authenticated && (s.sessionIdle(session) || s.sessionExpired(session) || s.sessionRevoked(r, session)) {
+			s.log(r).Info("Session expired", "path", r.URL.Path)
+			session.Values = make(map[interface{}]interface{})
+			session.Save(r, w)
+			authenticated = false
+		}
+		if !authenticated {
+			if wantsJSON(r) || isAPIRequest(r) {
+				// API clients can't follow a redirect into the login flow,
+				// so tell them where it starts instead.
+				login := s.path(r, "/login")
+				w.Header().Set("Link", "<"+login+`>; rel="login"`)
+				s.writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthenticated", "login_url": login})
+				return
+			}
+			if r.Method != http.MethodGet {
+				s.renderError(w, r, http.StatusUnauthorized, "Login required", "Your session has ended, please log in again.")
+				return
+			}
+			session.Values[keyNext] = r.URL.RequestURI()
+			session.Save(r, w)
+			http.Redirect(w, r, s.path(r, "/"), http.StatusSeeOther)
+			return
+		}
+
+		touchSession(session)
+		s.refreshTokenIfExpiring(r, session)
+		if err := session.Save(r, w); err != nil {
+			s.log(r).Error("Failed to save session", "path", r.URL.Path, "error", err)
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey, session)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func sessionFromContext(ctx context.Context) *sessions.Session {
+	session, _ := ctx.Value(sessionContextKey).(*sessions.Session)
+	return session
+}
+
+func (s *Server) sessionIdle(session *sessions.Session) bool {
+	lastSeen, ok := session.Values[keyLastSeen].(int64)
+	if !ok {
+		return true
+	}
+	timeout := s.cfg.SessionIdleTimeout
+	if remembered(session) {
+		timeout = s.cfg.RememberIdleTimeout
+	}
+	return time.Since(time.Unix(lastSeen, 0)) > timeout
+}
+
+// sessionExpired reports whether the login is older than SESSION_MAX_AGE,
+// however active the session has been since.
+func (s *Server) sessionExpired(session *sessions.Session) bool {
+	loginAt, ok := session.Values[keyLoginAt].(int64)
+	if !ok {
+		return true
+	}
+	return time.Since(time.Unix(loginAt, 0)) > s.cfg.SessionMaxAge
+}
+
+func touchSession(session *sessions.Session) {
+	session.Values[keyLastSeen] = time.Now().Unix()
+}
+
+func (s *Server) sessionRevoked(r *http.Request, session *sessions.Session) bool {
+	user := s.sessionUserKey(session)
+	current, err := s.generations.Current(user)
+	if err != nil {
+		s.log(r).Error("Failed to load session generation", "user", user, "error", err)
+		return true
+	}
+
+	gen, _ := session.Values[keyGeneration].(int64)
+	return gen != current
+}
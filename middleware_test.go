@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// editSession loads the session c holds for app, lets edit change it and
+// stores the result back in c's cookie jar, as if the server had saved it.
+func editSession(t *testing.T, s *Server, c *http.Client, app string, edit func(*sessions.Session)) {
+	t.Helper()
+	appURL, err := url.Parse(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, app+"/", nil)
+	for _, cookie := range c.Jar.Cookies(appURL) {
+		req.AddCookie(cookie)
+	}
+	session, err := s.store.Get(req, s.cfg.SessionName)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	edit(session)
+
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatalf("save session: %v", err)
+	}
+	c.Jar.SetCookies(appURL, rec.Result().Cookies())
+}
+
+func TestRequireAuthEnforcesMaxAge(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil), "SESSION_MAX_AGE=1h")
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+
+	tests := []struct {
+		name     string
+		edit     func(*sessions.Session)
+		wantCode int
+	}{
+		{"fresh login", func(*sessions.Session) {}, http.StatusOK},
+		{"login older than max age", func(session *sessions.Session) {
+			// Still active: only the absolute lifetime has run out.
+			session.Values[keyLoginAt] = time.Now().Add(-2 * time.Hour).Unix()
+		}, http.StatusSeeOther},
+		{"no login time", func(session *sessions.Session) {
+			delete(session.Values, keyLoginAt)
+		}, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newBrowser(t)
+			login(t, c, app.URL, "")
+			editSession(t, s, c, app.URL, tt.edit)
+
+			if resp, _ := get(t, c, app.URL+"/profile"); resp.StatusCode != tt.wantCode {
+				t.Fatalf("GET /profile: status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestCookieStoreAppliesMaxAgeToCodecs(t *testing.T) {
+	store := newCookieStore([][]byte{[]byte(testSessionSecret)}, &sessions.Options{Path: "/", MaxAge: 1})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.New(req, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values[keyUser] = "octocat"
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// securecookie timestamps have one second resolution, so the cookie
+	// is only past a one second MaxAge two seconds later.
+	time.Sleep(2100 * time.Millisecond)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	if _, err := store.New(req, "session"); err == nil {
+		t.Fatal("decoded a cookie older than the store's MaxAge")
+	}
+}
+
+func TestRequireAuthRejectsSessionsWithoutID(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil))
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	login(t, c, app.URL, "")
+	editSession(t, s, c, app.URL, func(session *sessions.Session) {
+		delete(session.Values, keyID)
+	})
+
+	if resp, _ := get(t, c, app.URL+"/api/me"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /api/me without a user ID: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// stateMACPrefix is signed along with the state so it can never be mistaken
+// for another value signed with SESSION_SECRET.
+const stateMACPrefix = "oauth_state."
+
+// stateMaxAge is how long a login may take between /login and /callback.
+const stateMaxAge = 10 * time.Minute
+
+var (
+	errStateMalformed = errors.New("malformed OAuth state")
+	errStateSignature = errors.New("invalid OAuth state signature")
+	errStateExpired   = errors.New("OAuth state has expired")
+)
+
+// oauthState is carried through the provider in the OAuth state parameter.
+// Nonce binds it to the browser that started the login; the session or the
+// state cookie holds the same nonce. Scopes is set only by /reauthorize and
+// marks a callback that must come back for the account already logged in.
+type oauthState struct {
+	Nonce    string   `json:"n"`
+	Provider string   `json:"p"`
+	Next     string   `json:"next,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	IssuedAt int64    `json:"iat"`
+}
+
+// signState encodes st as base64url(JSON) "." base64url(HMAC-SHA256).
+func (s *Server) signState(st oauthState) (string, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(s.cfg.SessionSecrets[0], stateMACPrefix+encoded)), nil
+}
+
+// parseState verifies the signature and age of a state produced by
+// signState and returns its fields.
+func (s *Server) parseState(raw string, now time.Time) (oauthState, error) {
+	encoded, sig, ok := strings.Cut(raw, ".")
+	if !ok {
+		return oauthState{}, errStateMalformed
+	}
+	gotMAC, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return oauthState{}, errStateMalformed
+	}
+	if !validMAC(s.cfg.SessionSecrets, stateMACPrefix+encoded, gotMAC) {
+		return oauthState{}, errStateSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return oauthState{}, errStateMalformed
+	}
+	var st oauthState
+	if err := json.Unmarshal(payload, &st); err != nil || st.Nonce == "" {
+		return oauthState{}, errStateMalformed
+	}
+
+	issued := time.Unix(st.IssuedAt, 0)
+	if now.Sub(issued) > stateMaxAge || issued.After(now.Add(time.Minute)) {
+		return oauthState{}, errStateExpired
+	}
+	return st, nil
+}
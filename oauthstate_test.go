@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stateServer(secrets ...string) *Server {
+	cfg := &Config{}
+	for _, secret := range secrets {
+		cfg.SessionSecrets = append(cfg.SessionSecrets, []byte(secret))
+	}
+	return &Server{cfg: cfg}
+}
+
+func TestParseState(t *testing.T) {
+	const (
+		current  = "0123456789abcdef0123456789abcdef"
+		previous = "fedcba9876543210fedcba9876543210"
+		other    = "ffffffffffffffffffffffffffffffff"
+	)
+	now := time.Unix(1_700_000_000, 0)
+	valid := oauthState{Nonce: "nonce", Provider: "github", Next: "/repos", IssuedAt: now.Unix()}
+
+	sign := func(t *testing.T, s *Server, st oauthState) string {
+		t.Helper()
+		raw, err := s.signState(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	withIssuedAt := func(d time.Duration) oauthState {
+		st := valid
+		st.IssuedAt = now.Add(d).Unix()
+		return st
+	}
+
+	tests := []struct {
+		name    string
+		parser  *Server
+		raw     func(t *testing.T) string
+		wantErr error
+	}{
+		{"valid", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(current), valid)
+		}, nil},
+		{"tampered payload", stateServer(current), func(t *testing.T) string {
+			_, sig, _ := strings.Cut(sign(t, stateServer(current), valid), ".")
+			forged := base64.RawURLEncoding.EncodeToString([]byte(`{"n":"nonce","p":"github","next":"//evil.com","iat":1700000000}`))
+			return forged + "." + sig
+		}, errStateSignature},
+		{"wrong key", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(other), valid)
+		}, errStateSignature},
+		{"signed with the previous secret after a rotation", stateServer(current, previous), func(t *testing.T) string {
+			return sign(t, stateServer(previous), valid)
+		}, nil},
+		{"previous secret once retired", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(previous), valid)
+		}, errStateSignature},
+		{"expired", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(current), withIssuedAt(-stateMaxAge-time.Second))
+		}, errStateExpired},
+		{"just inside the max age", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(current), withIssuedAt(-stateMaxAge+time.Second))
+		}, nil},
+		{"issued in the future", stateServer(current), func(t *testing.T) string {
+			return sign(t, stateServer(current), withIssuedAt(2*time.Minute))
+		}, errStateExpired},
+		{"empty nonce", stateServer(current), func(t *testing.T) string {
+			st := valid
+			st.Nonce = ""
+			return sign(t, stateServer(current), st)
+		}, errStateMalformed},
+		{"no signature", stateServer(current), func(t *testing.T) string {
+			encoded, _, _ := strings.Cut(sign(t, stateServer(current), valid), ".")
+			return encoded
+		}, errStateMalformed},
+		{"signature not base64", stateServer(current), func(t *testing.T) string {
+			encoded, _, _ := strings.Cut(sign(t, stateServer(current), valid), ".")
+			return encoded + ".!!!"
+		}, errStateMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := tt.parser.parseState(tt.raw(t), now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseState error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (st.Nonce != valid.Nonce || st.Provider != valid.Provider || st.Next != valid.Next) {
+				t.Errorf("parseState = %+v, want %+v", st, valid)
+			}
+		})
+	}
+}
+
+// A state must not verify as another value signed with the same secret.
+func TestStateMACIsDomainSeparated(t *testing.T) {
+	s := stateServer(testSessionSecret)
+	raw, err := s.signState(oauthState{Nonce: "nonce", Provider: "github", IssuedAt: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _, _ := strings.Cut(raw, ".")
+	plainMAC := base64.RawURLEncoding.EncodeToString(hmacSHA256([]byte(testSessionSecret), encoded))
+	if _, err := s.parseState(encoded+"."+plainMAC, time.Now()); !errors.Is(err, errStateSignature) {
+		t.Fatalf("state without the MAC prefix: error %v, want %v", err, errStateSignature)
+	}
+}
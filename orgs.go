@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxOrgPages bounds the /user/orgs pagination; 1000 organizations is far
+// beyond any real membership list.
+const maxOrgPages = 10
+
+type GitHubOrg struct {
+	Login string `json:"login"`
+}
+
+// loginAllowed applies ALLOWED_USERS and ALLOWED_ORGS. With neither set
+// everyone may log in; otherwise a GitHub user must be listed in either.
+// GitHub logins are case-insensitive, so they are compared lowercased.
+func (s *Server) loginAllowed(ctx context.Context, provider Provider, client *http.Client, user User) (bool, error) {
+	if len(s.cfg.AllowedUsers) == 0 && len(s.cfg.AllowedOrgs) == 0 {
+		return true, nil
+	}
+	if provider.Name() == "github" && slices.Contains(s.cfg.AllowedUsers, strings.ToLower(user.Login)) {
+		return true, nil
+	}
+	if len(s.cfg.AllowedOrgs) == 0 {
+		return false, nil
+	}
+	return s.inAllowedOrg(ctx, provider, client)
+}
+
+// inAllowedOrg reports whether the user behind client belongs to one of
+// ALLOWED_ORGS. Only GitHub exposes organizations, so logins through other
+// providers never pass the gate.
+func (s *Server) inAllowedOrg(ctx context.Context, provider Provider, client *http.Client) (bool, error) {
+	if provider.Name() != "github" {
+		return false, nil
+	}
+
+	orgs, err := fetchOrgs(ctx, client, s.cfg.GitHubAPIURL, s.githubAPIPolicy())
+	if err != nil {
+		return false, err
+	}
+	for _, org := range orgs {
+		if slices.Contains(s.cfg.AllowedOrgs, strings.ToLower(org.Login)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetchOrgs lists the organizations visible to the token. Organizations
+// that restrict OAuth app access are left out by GitHub until an owner
+// approves the app.
+func fetchOrgs(ctx context.Context, client *http.Client, apiURL string, policy fetchPolicy) ([]GitHubOrg, error) {
+	return fetchAllPages[GitHubOrg](ctx, client, apiURL+"/user/orgs?per_page=100", policy, maxOrgPages)
+}
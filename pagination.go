@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// fetchAllPages GETs a GitHub list endpoint and follows its rel="next"
+// links, appending each page's array into one slice. It stops after
+// maxPages pages, returning what it has, and every request goes through
+// safeFetch with policy. A non-200 page fails with an *apiError.
+func fetchAllPages[T any](ctx context.Context, client *http.Client, url string, policy fetchPolicy, maxPages int) ([]T, error) {
+	var items []T
+
+	next := url
+	for page := 0; next != "" && page < maxPages; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := safeFetch(client, req, policy)
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []T
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&batch)
+		} else {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			err = &apiError{URL: next, Status: resp.StatusCode, Body: string(body), Header: resp.Header}
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, batch...)
+		next = nextPageURL(resp.Header.Get("Link"))
+	}
+
+	return items, nil
+}
+
+// nextPageURL extracts the rel="next" target from a GitHub Link header.
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		segments := strings.Split(part, ";")
+		if len(segments) < 2 {
+			continue
+		}
+
+		target := strings.TrimSpace(segments[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		for _, param := range segments[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(target, "<>")
+			}
+		}
+	}
+	return ""
+}
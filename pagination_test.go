@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// newPagedServer serves GET /items?page=N as [N*10, N*10+1] with a
+// rel="next" link until last, whose response has no next link. Page fail,
+// when non-zero, answers 500 instead.
+func newPagedServer(t *testing.T, last, fail int) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			page = 1
+		}
+		if page == fail {
+			http.Error(w, `{"message":"Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if page < last {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/items?page=%d>; rel="next", <%s/items?page=%d>; rel="last"`,
+				srv.URL, page+1, srv.URL, last))
+		}
+		fmt.Fprintf(w, "[%d, %d]", page*10, page*10+1)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchAllPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		last     int
+		fail     int
+		maxPages int
+		want     []int
+		wantErr  bool
+	}{
+		{"single page", 1, 0, 10, []int{10, 11}, false},
+		{"two pages then a terminating page", 3, 0, 10, []int{10, 11, 20, 21, 30, 31}, false},
+		{"stops at maxPages", 3, 0, 2, []int{10, 11, 20, 21}, false},
+		{"failing page", 3, 2, 10, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newPagedServer(t, tt.last, tt.fail)
+			policy := fetchPolicy{hosts: []string{urlHost(srv.URL)}, allowInternal: true}
+
+			got, err := fetchAllPages[int](context.Background(), srv.Client(), srv.URL+"/items?page=1", policy, tt.maxPages)
+			if tt.wantErr {
+				var apiErr *apiError
+				if !errors.As(err, &apiErr) || apiErr.Status != http.StatusInternalServerError {
+					t.Fatalf("fetchAllPages error = %v, want an *apiError with status 500", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fetchAllPages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A next link pointing off the policy's hosts is refused rather than
+// followed with the user's token.
+func TestFetchAllPagesRefusesForeignNextLink(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `<https://evil.example/items?page=2>; rel="next"`)
+		fmt.Fprint(w, "[1]")
+	}))
+	defer srv.Close()
+	policy := fetchPolicy{hosts: []string{urlHost(srv.URL)}, allowInternal: true}
+
+	if _, err := fetchAllPages[int](context.Background(), srv.Client(), srv.URL+"/items", policy, 10); !errors.Is(err, errUnsafeURL) {
+		t.Fatalf("fetchAllPages error = %v, want errUnsafeURL", err)
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"", ""},
+		{`<https://api.github.com/user/repos?page=2>; rel="next", <https://api.github.com/user/repos?page=5>; rel="last"`, "https://api.github.com/user/repos?page=2"},
+		{`<https://api.github.com/user/repos?page=1>; rel="prev", <https://api.github.com/user/repos?page=1>; rel="first"`, ""},
+		{`https://api.github.com/user/repos?page=2; rel="next"`, ""},
+	}
+	for _, tt := range tests {
+		if got := nextPageURL(tt.link); got != tt.want {
+			t.Errorf("nextPageURL(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
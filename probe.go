@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 5 * time.Second
+
+// probeEndpoints checks that every host the app talks to for logins, the
+// providers' authorize and token endpoints and the GitHub API, answers an
+// HTTP request, so a blocked egress shows up in the startup logs instead of
+// on the first login. Any response counts as reachable; failures are only
+// logged.
+func (s *Server) probeEndpoints(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, origin := range s.probeOrigins() {
+		wg.Add(1)
+		go func(origin string) {
+			defer wg.Done()
+			if err := probe(ctx, s.httpClient, origin); err != nil {
+				s.logger.Warn("Startup probe: endpoint unreachable", "url", origin, "error", err)
+				return
+			}
+			s.logger.Info("Startup probe: endpoint reachable", "url", origin)
+		}(origin)
+	}
+	wg.Wait()
+}
+
+// probeOrigins returns the distinct scheme://host origins of the configured
+// OAuth and API endpoints.
+func (s *Server) probeOrigins() []string {
+	urls := []string{s.cfg.GitHubAPIURL}
+	for _, p := range s.providers {
+		endpoint := p.Config().Endpoint
+		urls = append(urls, endpoint.AuthURL, endpoint.TokenURL)
+	}
+
+	seen := make(map[string]bool)
+	var origins []string
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		origin := u.Scheme + "://" + u.Host + "/"
+		if !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+func probe(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
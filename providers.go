@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const defaultProvider = "github"
+
+// errEmailLookup is wrapped by the error FetchUser returns, together with
+// an otherwise complete User, when only the email lookup failed.
+var errEmailLookup = errors.New("failed to fetch user emails")
+
+// User is the provider-independent profile stored in the session after login.
+// ID is the provider's stable account identifier; logins and emails can
+// change, so anything keyed by user should use ID.
+type User struct {
+	ID          string
+	Login       string
+	Name        string
+	Email       string
+	AvatarURL   string
+	PublicRepos *int
+	Followers   *int
+}
+
+type Provider interface {
+	Name() string
+	Label() string
+	Config() *oauth2.Config
+	FetchUser(ctx context.Context, client *http.Client) (User, error)
+}
+
+// tokenRevoker is implemented by providers that can revoke an access token
+// on logout. client is the plain outbound client, not one carrying the token.
+type tokenRevoker interface {
+	RevokeToken(ctx context.Context, client *http.Client, accessToken string) error
+}
+
+// TokenExchanger trades an authorization code for a token. The callback
+// goes through it rather than the oauth2.Config directly so tests can
+// substitute a fake that returns a canned token.
+type TokenExchanger interface {
+	Exchange(ctx context.Context, code string) (*oauth2.Token, error)
+}
+
+// configExchanger is the TokenExchanger backed by a provider's token
+// endpoint.
+type configExchanger struct {
+	config *oauth2.Config
+}
+
+func (e configExchanger) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	return e.config.Exchange(ctx, code)
+}
+
+func newProviders(cfg *Config, githubConfig *oauth2.Config) map[string]Provider {
+	providers := map[string]Provider{
+		"github": &githubProvider{config: githubConfig, apiURL: cfg.GitHubAPIURL},
+	}
+
+	if id, secret := cfg.GitLabClientID, cfg.GitLabClientSecret; id != "" && secret != "" {
+		providers["gitlab"] = &gitlabProvider{config: &oauth2.Config{
+			ClientID:     id,
+			ClientSecret: secret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{"read_user"},
+			Endpoint:     endpoints.GitLab,
+		}}
+	}
+
+	if id, secret := cfg.GoogleClientID, cfg.GoogleClientSecret; id != "" && secret != "" {
+		providers["google"] = &googleProvider{config: &oauth2.Config{
+			ClientID:     id,
+			ClientSecret: secret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       []string{"openid", "profile", "email"},
+			Endpoint:     endpoints.Google,
+		}}
+	}
+	return providers
+}
+
+func (s *Server) enabledProviders() []Provider {
+	list := make([]Provider, 0, len(s.providers))
+	for _, p := range s.providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name() == defaultProvider {
+			return true
+		}
+		if list[j].Name() == defaultProvider {
+			return false
+		}
+		return list[i].Name() < list[j].Name()
+	})
+	return list
+}
+
+// sessionProvider returns the provider the session logged in with. Sessions
+// created before multiple providers were supported fall back to GitHub.
+func (s *Server) sessionProvider(session *sessions.Session) Provider {
+	if p, ok := s.providers[getStringFromSession(session, keyProvider)]; ok {
+		return p
+	}
+	return s.providers[defaultProvider]
+}
+
+func userKey(provider, id string) string {
+	return provider + ":" + id
+}
+
+func (s *Server) sessionUserKey(session *sessions.Session) string {
+	return userKey(s.sessionProvider(session).Name(), getStringFromSession(session, keyID))
+}
+
+// apiError is returned when an upstream API answers with a non-200 status.
+type apiError struct {
+	URL    string
+	Status int
+	Body   string
+	Header http.Header
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.Status, e.URL)
+}
+
+// rateLimitReset reports whether the response was a GitHub rate-limit
+// rejection and, if so, when the client may retry.
+func (e *apiError) rateLimitReset() (time.Time, bool) {
+	if e.Status != http.StatusForbidden && e.Status != http.StatusTooManyRequests {
+		return time.Time{}, false
+	}
+
+	if secs, err := strconv.Atoi(e.Header.Get("Retry-After")); err == nil {
+		return time.Now().Add(time.Duration(secs) * time.Second), true
+	}
+	if e.Header.Get("X-RateLimit-Remaining") != "0" {
+		return time.Time{}, false
+	}
+	if unix, err := strconv.ParseInt(e.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Unix(unix, 0), true
+	}
+	return time.Now().Add(time.Minute), true
+}
+
+// ssoURL reports whether the response was GitHub refusing a token that has
+// not been authorized for an organization's SAML SSO, and if so returns the
+// URL where the user can authorize it, from
+// "X-GitHub-SSO: required; url=...".
+func (e *apiError) ssoURL() (string, bool) {
+	if e.Status != http.StatusForbidden {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(e.Header.Get("X-GitHub-SSO"), "required;")
+	if !ok {
+		return "", false
+	}
+	raw, ok := strings.CutPrefix(strings.TrimSpace(rest), "url=")
+	if !ok {
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &apiError{URL: url, Status: resp.StatusCode, Body: string(body), Header: resp.Header}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type GitHubUser struct {
+	ID          int    `json:"id"`
+	Login       string `json:"login"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	AvatarURL   string `json:"avatar_url"`
+	PublicRepos *int   `json:"public_repos"`
+	Followers   *int   `json:"followers"`
+}
+
+type GitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+type githubProvider struct {
+	config *oauth2.Config
+	apiURL string
+}
+
+func (p *githubProvider) Name() string           { return "github" }
+func (p *githubProvider) Label() string          { return "GitHub" }
+func (p *githubProvider) Config() *oauth2.Config { return p.config }
+
+func (p *githubProvider) FetchUser(ctx context.Context, client *http.Client) (User, error) {
+	var gh GitHubUser
+	if err := getJSON(ctx, client, p.apiURL+"/user", &gh); err != nil {
+		return User{}, err
+	}
+
+	var emailErr error
+	if email, err := p.fetchPrimaryEmail(ctx, client); err != nil {
+		emailErr = fmt.Errorf("%w: %w", errEmailLookup, err)
+	} else if email != "" {
+		gh.Email = email
+	}
+
+	return User{
+		ID:          strconv.Itoa(gh.ID),
+		Login:       gh.Login,
+		Name:        gh.Name,
+		Email:       gh.Email,
+		AvatarURL:   gh.AvatarURL,
+		PublicRepos: gh.PublicRepos,
+		Followers:   gh.Followers,
+	}, emailErr
+}
+
+// RevokeToken deletes the OAuth grant behind accessToken using the app's
+// client credentials.
+func (p *githubProvider) RevokeToken(ctx context.Context, client *http.Client, accessToken string) error {
+	body, err := json.Marshal(map[string]string{"access_token": accessToken})
+	if err != nil {
+		return err
+	}
+
+	revokeURL := p.apiURL + "/applications/" + url.PathEscape(p.config.ClientID) + "/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, revokeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.config.ClientID, p.config.ClientSecret)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 404 means the token was already revoked or expired.
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status %d from token revocation", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *githubProvider) fetchPrimaryEmail(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.apiURL+"/user/emails", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from /user/emails", resp.StatusCode)
+	}
+
+	var emails []GitHubEmail
+	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+		return "", err
+	}
+
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
+}
+
+type gitlabProvider struct {
+	config *oauth2.Config
+}
+
+func (p *gitlabProvider) Name() string           { return "gitlab" }
+func (p *gitlabProvider) Label() string          { return "GitLab" }
+func (p *gitlabProvider) Config() *oauth2.Config { return p.config }
+
+func (p *gitlabProvider) FetchUser(ctx context.Context, client *http.Client) (User, error) {
+	var gl struct {
+		ID        int    `json:"id"`
+		Username  string `json:"username"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, "https://gitlab.com/api/v4/user", &gl); err != nil {
+		return User{}, err
+	}
+
+	return User{
+		ID:        strconv.Itoa(gl.ID),
+		Login:     gl.Username,
+		Name:      gl.Name,
+		Email:     gl.Email,
+		AvatarURL: gl.AvatarURL,
+	}, nil
+}
+
+type googleProvider struct {
+	config *oauth2.Config
+}
+
+func (p *googleProvider) Name() string           { return "google" }
+func (p *googleProvider) Label() string          { return "Google" }
+func (p *googleProvider) Config() *oauth2.Config { return p.config }
+
+func (p *googleProvider) FetchUser(ctx context.Context, client *http.Client) (User, error) {
+	var g struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Picture       string `json:"picture"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &g); err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		ID:        g.Sub,
+		Login:     g.Email,
+		Name:      g.Name,
+		AvatarURL: g.Picture,
+	}
+	if g.EmailVerified {
+		user.Email = g.Email
+	}
+	return user, nil
+}
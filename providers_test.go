@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// userEndpoints are the GET /user behaviours the provider and callback
+// tests run against, with the status the callback should answer. The
+// network error case drops the connection.
+var userEndpoints = []struct {
+	name           string
+	handler        http.HandlerFunc
+	callbackStatus int
+}{
+	{"success", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testUser)
+	}, http.StatusSeeOther},
+	{"non-200", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Server Error"}`, http.StatusInternalServerError)
+	}, http.StatusBadGateway},
+	{"malformed JSON", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":42,"login":`)
+	}, http.StatusBadGateway},
+	{"network error", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}, http.StatusBadGateway},
+}
+
+// userAPI serves GET /user with user and the other routes as githubAPI
+// does.
+func userAPI(user http.HandlerFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", githubAPI(testUser))
+	mux.HandleFunc("/user", user)
+	return mux
+}
+
+func TestGitHubProviderFetchUser(t *testing.T) {
+	for _, tt := range userEndpoints {
+		t.Run(tt.name, func(t *testing.T) {
+			api := httptest.NewServer(userAPI(tt.handler))
+			defer api.Close()
+			p := &githubProvider{config: &oauth2.Config{}, apiURL: api.URL}
+
+			user, err := p.FetchUser(context.Background(), api.Client())
+
+			var apiErr *apiError
+			switch tt.name {
+			case "success":
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.ID != "42" || user.Login != "octocat" || user.Name != "The Octocat" {
+					t.Errorf("FetchUser = %+v, want octocat with ID 42", user)
+				}
+			case "non-200":
+				if !errors.As(err, &apiErr) || apiErr.Status != http.StatusInternalServerError {
+					t.Fatalf("FetchUser error = %v, want an *apiError with status 500", err)
+				}
+			default:
+				if err == nil || errors.As(err, &apiErr) {
+					t.Fatalf("FetchUser error = %v, want a non-API error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGitHubProviderFetchUserPrimaryEmail(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", githubAPI(testUser))
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"email":"old@example.com","primary":false,"verified":true},`+
+			`{"email":"octo@example.com","primary":true,"verified":true}]`)
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+	p := &githubProvider{config: &oauth2.Config{}, apiURL: api.URL}
+
+	user, err := p.FetchUser(context.Background(), api.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "octo@example.com" {
+		t.Errorf("Email = %q, want the verified primary address", user.Email)
+	}
+}
+
+func TestCallbackUserErrors(t *testing.T) {
+	for _, tt := range userEndpoints {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeGitHub(t, userAPI(tt.handler)))
+			app := httptest.NewServer(s.routes())
+			defer app.Close()
+			c := newBrowser(t)
+
+			if resp := login(t, c, app.URL, ""); resp.StatusCode != tt.callbackStatus {
+				t.Fatalf("callback: status %d, want %d", resp.StatusCode, tt.callbackStatus)
+			}
+			// Only a successful callback logs the user in.
+			wantProfile := http.StatusSeeOther
+			if tt.callbackStatus == http.StatusSeeOther {
+				wantProfile = http.StatusOK
+			}
+			if resp, _ := get(t, c, app.URL+"/profile"); resp.StatusCode != wantProfile {
+				t.Fatalf("GET /profile: status %d, want %d", resp.StatusCode, wantProfile)
+			}
+		})
+	}
+}
+
+// fakeExchanger is a TokenExchanger that returns token for any code and
+// records the codes it was given.
+type fakeExchanger struct {
+	token *oauth2.Token
+	codes *[]string
+}
+
+func (e fakeExchanger) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+	*e.codes = append(*e.codes, code)
+	return e.token, nil
+}
+
+func TestCallbackUsesExchanger(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil))
+	var codes []string
+	token := (&oauth2.Token{AccessToken: "gho_canned", TokenType: "bearer", RefreshToken: "ghr_canned"}).
+		WithExtra(map[string]interface{}{"scope": "user:email"})
+	s.exchanger = func(Provider) TokenExchanger { return fakeExchanger{token: token, codes: &codes} }
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	if resp := login(t, c, app.URL, ""); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	if len(codes) != 1 || codes[0] != "test-code" {
+		t.Errorf("exchanged codes %v, want [test-code]", codes)
+	}
+	editSession(t, s, c, app.URL, func(session *sessions.Session) {
+		stored, _ := session.Values[keyToken].(*StoredToken)
+		if stored == nil || stored.AccessToken != "gho_canned" || stored.RefreshToken != "ghr_canned" {
+			t.Errorf("session token = %+v, want the canned token", stored)
+		}
+		if granted, _ := sessionScopes(session); len(granted) != 1 || granted[0] != "user:email" {
+			t.Errorf("session scopes = %v, want [user:email]", granted)
+		}
+	})
+}
+
+// A token endpoint answering garbage is GitHub failing, not the app.
+func TestCallbackTokenEndpointMalformed(t *testing.T) {
+	gh := newFakeGitHub(t, nil)
+	fallback := gh.Config.Handler
+	gh.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login/oauth/access_token" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":`)
+	})
+	s := newTestServer(t, gh)
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+
+	if resp := login(t, newBrowser(t), app.URL, ""); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("callback: status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+// A failed email lookup does not fail the login; it is logged with the
+// request ID.
+func TestCallbackLogsEmailLookupFailure(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/", githubAPI(testUser))
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Server Error"}`, http.StatusInternalServerError)
+	})
+	gh := newFakeGitHub(t, mux)
+
+	p := &githubProvider{config: &oauth2.Config{}, apiURL: gh.URL + "/api/v3"}
+	user, err := p.FetchUser(context.Background(), gh.Client())
+	if !errors.Is(err, errEmailLookup) || user.Login != "octocat" {
+		t.Fatalf("FetchUser = %+v, %v, want octocat and errEmailLookup", user, err)
+	}
+
+	s := newTestServer(t, gh)
+	var logs bytes.Buffer
+	s.logger = slog.New(slog.NewTextHandler(&logs, nil))
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+
+	resp := login(t, newBrowser(t), app.URL, "")
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "Failed to fetch user emails") {
+			line = l
+		}
+	}
+	if id := resp.Header.Get("X-Request-ID"); line == "" || !strings.Contains(line, "request_id="+id) {
+		t.Errorf("email lookup failure logged as %q, want it with request_id=%s", line, id)
+	}
+}
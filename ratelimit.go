@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const visitorTTL = 10 * time.Minute
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter hands out a token bucket per client IP. Idle buckets are
+// swept lazily so the map does not grow without bound.
+type ipRateLimiter struct {
+	mu        sync.Mutex
+	visitors  map[string]*visitor
+	rate      rate.Limit
+	burst     int
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(perMinute, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		visitors: make(map[string]*visitor),
+		rate:     rate.Limit(float64(perMinute) / 60),
+		burst:    burst,
+	}
+}
+
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, v := range l.visitors {
+			if now.Sub(v.lastSeen) > visitorTTL {
+				delete(l.visitors, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	v, ok := l.visitors[ip]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.visitors[ip] = v
+	}
+	v.lastSeen = now
+	return v.limiter.Allow()
+}
+
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		if !s.authLimiter.allow(ip) {
+			s.log(r).Warn("Rate limit exceeded", "path", r.URL.Path, "ip", ip)
+			w.Header().Set("Retry-After", "60")
+			s.renderError(w, r, http.StatusTooManyRequests, "Too many requests", "Too many requests, please slow down.")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+var errInsufficientScope = errors.New("token lacks the scope required for this request")
+
+type GitHubRepo struct {
+	Name            string `json:"name"`
+	FullName        string `json:"full_name"`
+	Description     string `json:"description"`
+	HTMLURL         string `json:"html_url"`
+	StargazersCount int    `json:"stargazers_count"`
+}
+
+func (s *Server) reposHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionFromContext(r.Context())
+	if s.sessionProvider(session).Name() != "github" {
+		s.renderError(w, r, http.StatusBadRequest, "Repositories unavailable", "Repository listing is only available when logged in with GitHub.")
+		return
+	}
+
+	user := s.sessionUserKey(session)
+	repos, ok := s.repoCache.Get(user)
+	if !ok {
+		repos, ok = s.fetchReposForSession(w, r, session)
+		if !ok {
+			return
+		}
+		s.repoCache.Set(user, repos)
+	}
+
+	// Without repo the list only holds public repositories.
+	granted, known := sessionScopes(session)
+	data := struct {
+		Lang       string
+		User       string
+		Repos      []GitHubRepo
+		PublicOnly bool
+	}{
+		Lang:       requestLang(r),
+		User:       getStringFromSession(session, keyUser),
+		Repos:      repos,
+		PublicOnly: known && !scopeGranted("repo", granted),
+	}
+
+	s.renderTemplate(w, r, "repos", data)
+}
+
+// fetchReposForSession lists the session user's repositories from GitHub,
+// writing an error response and returning false on failure.
+func (s *Server) fetchReposForSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) ([]GitHubRepo, bool) {
+	client, ok := s.authenticatedClient(w, r, session)
+	if !ok {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.GitHubTimeout)
+	defer cancel()
+
+	repos, err := fetchRepos(ctx, client, s.cfg.GitHubAPIURL, s.githubAPIPolicy(), s.cfg.ReposMaxPages)
+	if errors.Is(err, errInsufficientScope) {
+		s.renderErrorPage(w, r, http.StatusForbidden, errorPage{
+			Title:    "Repositories unavailable",
+			Message:  "GitHub denied access to your repositories. Grant the app access to them and try again.",
+			RetryURL: s.path(r, "/reauthorize?scope=repo&next=/repos"),
+		})
+		return nil, false
+	}
+	if err != nil {
+		s.upstreamError(w, r, err, "Failed to list repositories")
+		return nil, false
+	}
+	return repos, true
+}
+
+func fetchRepos(ctx context.Context, client *http.Client, apiURL string, policy fetchPolicy, maxPages int) ([]GitHubRepo, error) {
+	repos, err := fetchAllPages[GitHubRepo](ctx, client, apiURL+"/user/repos?per_page=100", policy, maxPages)
+
+	// A plain 403 means the token lacks the scope; rate-limit and SSO
+	// rejections are left for upstreamError to report.
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusForbidden {
+		_, limited := apiErr.rateLimitReset()
+		_, sso := apiErr.ssoURL()
+		if !limited && !sso {
+			return nil, errInsufficientScope
+		}
+	}
+	return repos, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+const maxRequestIDLen = 64
+
+// requestID assigns every request an ID, reusing a well-formed incoming
+// X-Request-ID, and echoes it in the response so users can quote it.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID limits client-supplied IDs to short token strings so they
+// cannot inject anything into headers or logs.
+func validRequestID(id string) bool {
+	return id != "" && len(id) <= maxRequestIDLen && tokenChars(id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// log returns the server logger annotated with the request's ID.
+func (s *Server) log(r *http.Request) *slog.Logger {
+	if id := requestIDFromContext(r.Context()); id != "" {
+		return s.logger.With("request_id", id)
+	}
+	return s.logger
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errUnsafeURL = errors.New("refusing to fetch URL")
+
+// fetchPolicy describes which URLs safeFetch may request. Hosts starting with
+// "." match any subdomain.
+type fetchPolicy struct {
+	hosts []string
+	// allowInternal skips the internal address check. It is only for hosts
+	// the operator configured explicitly, such as a GitHub Enterprise Server
+	// on a private network.
+	allowInternal bool
+}
+
+// safeFetch sends req with client only if its URL, and every redirect it
+// follows, is https on one of the policy's hosts and does not resolve to a
+// loopback, private, link-local or otherwise internal address. Use it for any
+// request whose URL comes from user or upstream data rather than a constant.
+//
+// The lookup in checkFetchURL gives a clear error early, but DNS may answer
+// differently when the connection is made, so clients from newHTTPClient
+// check the dialed address again. Through a proxy only the lookup applies
+// and the proxy has to refuse internal destinations itself.
+func safeFetch(client *http.Client, req *http.Request, policy fetchPolicy) (*http.Response, error) {
+	if err := checkFetchURL(req, policy); err != nil {
+		return nil, err
+	}
+	if !policy.allowInternal {
+		req = req.WithContext(context.WithValue(req.Context(), denyInternalKey{}, true))
+	}
+
+	c := *client
+	c.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("%w: too many redirects", errUnsafeURL)
+		}
+		return checkFetchURL(next, policy)
+	}
+	return c.Do(req)
+}
+
+func checkFetchURL(req *http.Request, policy fetchPolicy) error {
+	u := req.URL
+	if u.Scheme != "https" || u.User != nil {
+		return fmt.Errorf("%w %q: only plain https URLs are allowed", errUnsafeURL, u.Redacted())
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if !hostAllowed(host, policy.hosts) {
+		return fmt.Errorf("%w %q: host is not allowlisted", errUnsafeURL, u.Redacted())
+	}
+	if policy.allowInternal {
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if internalIP(ip.IP) {
+			return fmt.Errorf("%w %q: resolves to internal address %s", errUnsafeURL, u.Redacted(), ip.IP)
+		}
+	}
+	return nil
+}
+
+func hostAllowed(host string, allowedHosts []string) bool {
+	for _, allowed := range allowedHosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	// NAT64 and 6to4 addresses reach the IPv4 address they embed.
+	if ip4 := embeddedIPv4(ip); ip4 != nil {
+		return internalIP(ip4)
+	}
+	return false
+}
+
+// nonPublicNets are the special-purpose ranges net.IP has no predicate for.
+var nonPublicNets = mustParseCIDRs(
+	"0.0.0.0/8",       // "this network"
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // TEST-NET-1
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // TEST-NET-2
+	"203.0.113.0/24",  // TEST-NET-3
+	"240.0.0.0/4",     // reserved, and the broadcast address
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard-only
+	"2001::/32",       // Teredo
+	"2001:db8::/32",   // documentation
+	"fec0::/10",       // deprecated site-local
+)
+
+var (
+	nat64Net  = mustParseCIDRs("64:ff9b::/96")[0]
+	sixToFour = mustParseCIDRs("2002::/16")[0]
+)
+
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+	switch {
+	case nat64Net.Contains(ip):
+		return net.IP(ip[12:16])
+	case sixToFour.Contains(ip):
+		return net.IP(ip[2:6])
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// denyInternalKey marks a request context whose connections must not reach
+// internal addresses.
+type denyInternalKey struct{}
+
+// internalGuard sends requests marked by safeFetch through deny, a copy of
+// allow whose dialer refuses internal addresses once they are resolved. The
+// two keep separate connection pools, so a marked request never reuses a
+// connection that was dialed unchecked.
+type internalGuard struct {
+	allow, deny *http.Transport
+}
+
+func newInternalGuard(t *http.Transport) *internalGuard {
+	deny := t.Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return fmt.Errorf("%w: connection to internal address %s", errUnsafeURL, host)
+			}
+			return nil
+		},
+	}
+	deny.DialContext = dialer.DialContext
+	return &internalGuard{allow: t, deny: deny}
+}
+
+func (g *internalGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if deny, _ := req.Context().Value(denyInternalKey{}).(bool); deny {
+		return g.deny.RoundTrip(req)
+	}
+	return g.allow.RoundTrip(req)
+}
+
+func urlHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// grantedScopes returns the scopes the provider reports granting with
+// token, from the "scope" field of the token response. GitHub separates
+// them with commas, the OAuth spec with spaces. ok is false when the
+// provider did not say.
+func grantedScopes(token *oauth2.Token) (scopes []string, ok bool) {
+	raw, ok := token.Extra("scope").(string)
+	if !ok {
+		return nil, false
+	}
+	return strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' }), true
+}
+
+// missingScopes returns the scopes requested from provider that granted
+// does not cover. Only GitHub is checked: Google reports its short scope
+// names as full URLs, so a comparison there would always find gaps.
+func missingScopes(provider Provider, requested, granted []string) []string {
+	if provider.Name() != "github" {
+		return nil
+	}
+	var missing []string
+	for _, scope := range requested {
+		if !scopeGranted(scope, granted) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// scopeGranted reports whether scope is in granted or implied by a broader
+// GitHub scope there: "user" covers "user:email", "repo" covers
+// "public_repo", and "admin:org" and "write:org" cover "read:org".
+func scopeGranted(scope string, granted []string) bool {
+	if slices.Contains(granted, scope) {
+		return true
+	}
+	if scope == "public_repo" {
+		return slices.Contains(granted, "repo")
+	}
+	level, resource, ok := strings.Cut(scope, ":")
+	if !ok {
+		return false
+	}
+	switch level {
+	case "read":
+		return slices.Contains(granted, "write:"+resource) || slices.Contains(granted, "admin:"+resource)
+	case "write":
+		return slices.Contains(granted, "admin:"+resource)
+	}
+	return slices.Contains(granted, level)
+}
+
+// sessionScopes returns the scopes stored by setSessionScopes; ok is false
+// for sessions whose provider did not report them.
+func sessionScopes(session *sessions.Session) (scopes []string, ok bool) {
+	raw, ok := session.Values[keyScopes].(string)
+	if !ok {
+		return nil, false
+	}
+	return strings.Fields(raw), true
+}
+
+func setSessionScopes(session *sessions.Session, scopes []string, ok bool) {
+	if !ok {
+		delete(session.Values, keyScopes)
+		return
+	}
+	session.Values[keyScopes] = strings.Join(scopes, " ")
+}
+
+// sessionMissingScopes returns which of the provider's requested scopes the
+// session's token was not granted. Sessions with unknown scopes are assumed
+// to have everything, so calls are still attempted.
+func (s *Server) sessionMissingScopes(session *sessions.Session) []string {
+	granted, ok := sessionScopes(session)
+	if !ok {
+		return nil
+	}
+	provider := s.sessionProvider(session)
+	return missingScopes(provider, provider.Config().Scopes, granted)
+}
+
+// incrementalScopes are the GitHub scopes /reauthorize may ask for beyond
+// GITHUB_SCOPES. Each is needed by a page that also works without it.
+var incrementalScopes = []string{"repo"}
+
+// reauthorizeHandler sends a logged-in GitHub user back to the consent page
+// for the scopes in ?scope= on top of those the session already has, so
+// elevated access is requested only once a page needs it. The callback
+// merges the new token into the current session and returns to ?next=.
+func (s *Server) reauthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionFromContext(r.Context())
+	provider := s.sessionProvider(session)
+	if provider.Name() != "github" {
+		s.renderError(w, r, http.StatusBadRequest, "Authorization unavailable", "Additional access can only be requested when logged in with GitHub.")
+		return
+	}
+
+	configured := provider.Config().Scopes
+	extra := splitList(r.URL.Query().Get("scope"))
+	if len(extra) == 0 {
+		s.renderError(w, r, http.StatusBadRequest, "Invalid request", "No access was requested.")
+		return
+	}
+	for _, scope := range extra {
+		if !slices.Contains(incrementalScopes, scope) && !slices.Contains(configured, scope) {
+			s.renderError(w, r, http.StatusBadRequest, "Invalid request", "This app does not request that access.")
+			return
+		}
+	}
+
+	scopes := slices.Clone(configured)
+	if granted, ok := sessionScopes(session); ok {
+		scopes = append(scopes, granted...)
+	}
+	scopes = append(scopes, extra...)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	next := safeRedirect(r.URL.Query().Get("next"), "/profile")
+	s.authorize(w, r, session, provider, oauthState{Next: next, Scopes: scopes})
+}
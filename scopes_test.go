@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestScopeGranted(t *testing.T) {
+	tests := []struct {
+		scope   string
+		granted []string
+		want    bool
+	}{
+		{"user:email", []string{"user:email"}, true},
+		{"user:email", []string{"user"}, true},
+		{"public_repo", []string{"repo"}, true},
+		{"read:org", []string{"write:org"}, true},
+		{"read:org", []string{"admin:org"}, true},
+		{"write:org", []string{"admin:org"}, true},
+		{"write:org", []string{"read:org"}, false},
+		{"repo", []string{"public_repo"}, false},
+		{"repo", nil, false},
+	}
+	for _, tt := range tests {
+		if got := scopeGranted(tt.scope, tt.granted); got != tt.want {
+			t.Errorf("scopeGranted(%q, %v) = %v, want %v", tt.scope, tt.granted, got, tt.want)
+		}
+	}
+}
+
+// reauthGitHub is a fake GitHub whose token endpoint grants scope and whose
+// /user endpoint returns user, both changeable between logins.
+type reauthGitHub struct {
+	*httptest.Server
+	mu    sync.Mutex
+	scope string
+	user  string
+}
+
+func newReauthGitHub(t *testing.T) *reauthGitHub {
+	gh := &reauthGitHub{scope: "user:email", user: testUser}
+	gh.Server = newFakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gh.mu.Lock()
+		user := gh.user
+		gh.mu.Unlock()
+		githubAPI(user).ServeHTTP(w, r)
+	}))
+	fallback := gh.Config.Handler
+	gh.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login/oauth/access_token" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		gh.mu.Lock()
+		scope := gh.scope
+		gh.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "gho_" + scope,
+			"token_type":   "bearer",
+			"scope":        scope,
+		})
+	})
+	return gh
+}
+
+func (gh *reauthGitHub) grant(scope, user string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.scope, gh.user = scope, user
+}
+
+// reauthorize follows /reauthorize with query to the provider and back to
+// the callback, returning the authorize URL and the callback response.
+func reauthorize(t *testing.T, c *http.Client, app, query string) (*url.URL, *http.Response) {
+	t.Helper()
+	resp, _ := get(t, c, app+"/reauthorize"+query)
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /reauthorize%s: status %d, want %d", query, resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = get(t, c, app+"/callback?code=test-code&state="+url.QueryEscape(authURL.Query().Get("state")))
+	return authURL, resp
+}
+
+func TestReauthorize(t *testing.T) {
+	gh := newReauthGitHub(t)
+	s := newTestServer(t, gh.Server)
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	if resp, _ := get(t, c, app.URL+"/reauthorize?scope=repo"); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("GET /reauthorize logged out: status %d, Location %q, want %d to /", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+
+	login(t, c, app.URL, "")
+	for _, query := range []string{"", "?scope=admin:org", "?scope=repo,delete_repo"} {
+		if resp, _ := get(t, c, app.URL+"/reauthorize"+query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /reauthorize%s: status %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	// The same account grants repo on top of what it had.
+	gh.grant("repo,user:email", testUser)
+	authURL, resp := reauthorize(t, c, app.URL, "?scope=repo&next=/repos")
+	if got, want := authURL.Query().Get("scope"), "repo user:email"; got != want {
+		t.Errorf("authorize URL scope = %q, want %q", got, want)
+	}
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/repos" {
+		t.Fatalf("callback: status %d, Location %q, want %d to /repos", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+	editSession(t, s, c, app.URL, func(session *sessions.Session) {
+		if granted, _ := sessionScopes(session); !scopeGranted("repo", granted) {
+			t.Errorf("session scopes = %v, want repo", granted)
+		}
+		if token, _ := session.Values[keyToken].(*StoredToken); token == nil || token.AccessToken != "gho_repo,user:email" {
+			t.Errorf("session token = %+v, want the reauthorized one", token)
+		}
+		if got := getStringFromSession(session, keyUser); got != "octocat" {
+			t.Errorf("session user = %q, want octocat", got)
+		}
+	})
+
+	// Consent given from another GitHub account does not replace the
+	// logged-in one.
+	gh.grant("repo,user:email", `{"id":43,"login":"hubot"}`)
+	if _, resp := reauthorize(t, c, app.URL, "?scope=repo"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("callback for another account: status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	editSession(t, s, c, app.URL, func(session *sessions.Session) {
+		if got := getStringFromSession(session, keyUser); got != "octocat" {
+			t.Errorf("session user = %q after another account's consent, want octocat", got)
+		}
+	})
+}
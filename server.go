@@ -0,0 +1,258 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// Server holds the dependencies shared by the handlers. Build one with
+// newServer and serve the handler returned by routes.
+type Server struct {
+	cfg         *Config
+	oauthConfig *oauth2.Config
+	providers   map[string]Provider
+	store       sessions.Store
+	generations generationStore
+	templates   *template.Template
+	logger      *slog.Logger
+	httpClient  *http.Client
+	authLimiter *ipRateLimiter
+	repoCache   *ttlCache[[]GitHubRepo]
+	// avatarHosts are the hosts avatar URLs from providers may point at.
+	avatarHosts []string
+	// usedNonces holds the OAuth state nonces already redeemed at the
+	// callback, for as long as their state would still be accepted.
+	usedNonces *ttlCache[struct{}]
+	// exchanger returns the TokenExchanger the callback uses for a provider.
+	exchanger func(Provider) TokenExchanger
+}
+
+func newServer(cfg *Config, logger *slog.Logger) (*Server, error) {
+	s := &Server{
+		cfg:    cfg,
+		logger: logger,
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint:     githubEndpoint(cfg),
+		},
+		authLimiter: newIPRateLimiter(cfg.RateLimitPerMinute, cfg.RateLimitBurst),
+		repoCache:   newTTLCache[[]GitHubRepo]("repos", cfg.CacheTTL),
+		usedNonces:  newTTLCache[struct{}]("oauth_nonces", stateMaxAge),
+		avatarHosts: avatarHosts(cfg),
+		exchanger: func(p Provider) TokenExchanger {
+			return configExchanger{p.Config()}
+		},
+	}
+	s.providers = newProviders(cfg, s.oauthConfig)
+
+	var err error
+	s.templates, err = s.parseTemplates(templateFS)
+	if err != nil {
+		return nil, err
+	}
+
+	s.httpClient, err = newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.store, err = newSessionStore(cfg, &sessions.Options{
+		Path:     cookiePath(cfg.BasePath),
+		Domain:   cfg.CookieDomain,
+		MaxAge:   int(cfg.SessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   cfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.generations = newGenerationStore(s.store)
+
+	if cfg.Dev {
+		logger.Info("Development mode enabled, templates are reloaded from disk on every request")
+	}
+	return s, nil
+}
+
+// githubWebURL is the GitHub site users log in to: github.com or the
+// GitHub Enterprise Server at GITHUB_BASE_URL.
+func githubWebURL(cfg *Config) string {
+	if cfg.GitHubBaseURL == "" {
+		return "https://github.com"
+	}
+	return cfg.GitHubBaseURL
+}
+
+// githubEndpoint is github.com's OAuth endpoint, or the GitHub Enterprise
+// Server equivalent when GITHUB_BASE_URL is set.
+func githubEndpoint(cfg *Config) oauth2.Endpoint {
+	if cfg.GitHubBaseURL == "" {
+		return github.Endpoint
+	}
+	return oauth2.Endpoint{
+		AuthURL:  cfg.GitHubBaseURL + "/login/oauth/authorize",
+		TokenURL: cfg.GitHubBaseURL + "/login/oauth/access_token",
+	}
+}
+
+// githubAPIPolicy allows requests to the configured GitHub API host. An
+// API URL the operator set explicitly may live on a private network.
+func (s *Server) githubAPIPolicy() fetchPolicy {
+	return fetchPolicy{
+		hosts:         []string{urlHost(s.cfg.GitHubAPIURL)},
+		allowInternal: s.cfg.GitHubAPIURL != defaultGitHubAPIURL,
+	}
+}
+
+// routes registers every handler on a fresh mux and wraps it in the global
+// middleware.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	get, post := http.MethodGet, http.MethodPost
+	mux.HandleFunc("/", s.homeHandler)
+	mux.HandleFunc("/login", s.allowMethods(s.rateLimit(s.loginHandler), get))
+	mux.HandleFunc("/login/", s.allowMethods(s.rateLimit(s.loginHandler), get))
+	mux.HandleFunc("/reauthorize", s.allowMethods(s.rateLimit(s.requireAuth(s.reauthorizeHandler)), get))
+	mux.HandleFunc("/callback", s.allowMethods(s.rateLimit(s.callbackHandler), get))
+	mux.HandleFunc("/profile", s.allowMethods(s.requireAuth(s.profileHandler), get))
+	mux.HandleFunc("/profile/refresh", s.allowMethods(s.requireAuth(s.profileRefreshHandler), post))
+	mux.HandleFunc("/profile/clear", s.allowMethods(s.requireAuth(s.profileClearHandler), post))
+	mux.HandleFunc("/repos", s.allowMethods(s.requireAuth(s.reposHandler), get))
+	mux.HandleFunc("/avatar/", s.allowMethods(s.requireAuth(s.avatarHandler), get))
+	mux.HandleFunc("/api/me", s.allowMethods(s.requireAuth(s.apiMeHandler), get))
+	mux.HandleFunc("/logout", s.allowMethods(s.logoutHandler, post))
+	mux.HandleFunc("/logout/all", s.allowMethods(s.requireAuth(s.logoutAllHandler), get, post))
+	mux.HandleFunc("/account/delete", s.allowMethods(s.requireAuth(s.accountDeleteHandler), get, post))
+	mux.HandleFunc("/theme", s.allowMethods(s.themeHandler, post))
+	mux.HandleFunc("/logged-out", s.allowMethods(s.loggedOutHandler, get))
+	mux.HandleFunc("/static/", s.allowMethods(staticHandler(s.cfg.Dev).ServeHTTP, get))
+	mux.HandleFunc("/healthz", s.allowMethods(healthzHandler, get))
+	mux.HandleFunc("/readyz", s.allowMethods(s.readyzHandler, get))
+	mux.HandleFunc("/version", s.allowMethods(s.versionHandler, get))
+	mux.HandleFunc("/metrics", s.allowMethods(promhttp.Handler().ServeHTTP, get))
+	mux.HandleFunc("/debug/session", s.allowMethods(s.debugSessionHandler, get))
+	// Outermost first. requestID comes before anything that logs. The
+	// logger's status recorder sits outside compress, which forwards
+	// WriteHeader to it. recoverPanics is inside both so the 500 page it
+	// writes is logged and compressed, and inside securityHeaders so that
+	// page carries them. mount strips BASE_PATH just before routing, so
+	// logs show the full path and metrics the route pattern, and
+	// limitConcurrency sees the same paths as the mux when exempting
+	// monitoring routes.
+	return chain(instrument(mux),
+		requestID,
+		s.logRequests,
+		compress,
+		securityHeaders(s.cfg.ContentSecurityPolicy),
+		s.recoverPanics,
+		s.parseForms,
+		s.mount,
+		s.limitConcurrency,
+	)
+}
+
+// mount serves next under BASE_PATH. Handlers see root-relative paths, so
+// anything they send back to the browser must go through s.path, which also
+// covers a proxy that strips its own prefix and sends X-Forwarded-Prefix. The bare
+// prefix redirects to its trailing-slash form; everything else outside the
+// prefix is a 404.
+func (s *Server) mount(next http.Handler) http.Handler {
+	base := s.cfg.BasePath
+	if base == "" {
+		return next
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(base+"/", http.StripPrefix(base, next))
+	mux.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	return mux
+}
+
+// path turns a root-relative app path such as "/profile" into the URL path
+// the browser sees for r.
+func (s *Server) path(r *http.Request, p string) string {
+	return s.prefix(r) + p
+}
+
+// prefix is the path the browser sees in front of app paths. BASE_PATH is
+// the single source of truth when set, since the proxy then forwards it
+// unchanged; otherwise, with TRUST_PROXY, a trusted proxy that strips its
+// own prefix can name it in X-Forwarded-Prefix.
+func (s *Server) prefix(r *http.Request) string {
+	if !s.forwardedPrefixes() || !s.fromTrustedProxy(r) {
+		return s.cfg.BasePath
+	}
+	p, err := basePath(r.Header.Get("X-Forwarded-Prefix"))
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// forwardedPrefixes reports whether prefix can vary per request.
+func (s *Server) forwardedPrefixes() bool {
+	return s.cfg.TrustProxy && s.cfg.BasePath == ""
+}
+
+// cookiePath scopes cookies to the app's mount point.
+func cookiePath(base string) string {
+	if base == "" {
+		return "/"
+	}
+	return base + "/"
+}
+
+// renewSession gives session a new server-side ID, if the store keeps one,
+// so an ID planted in the browser before login does not carry the login.
+// Cookie and JWT sessions hold their values in the cookie and get a new one
+// on the next Save.
+func (s *Server) renewSession(session *sessions.Session) error {
+	if renewer, ok := s.store.(interface {
+		Renew(*sessions.Session) error
+	}); ok {
+		return renewer.Renew(session)
+	}
+	return nil
+}
+
+// userSessions is implemented by stores that can find and delete every
+// server-side session of a user.
+type userSessions interface {
+	Track(user string, session *sessions.Session) error
+	DeleteAll(user string) error
+}
+
+// trackSession records a saved session under user, if the store keeps
+// server-side sessions.
+func (s *Server) trackSession(user string, session *sessions.Session) error {
+	if us, ok := s.store.(userSessions); ok {
+		return us.Track(user, session)
+	}
+	return nil
+}
+
+// deleteUserSessions deletes every server-side session tracked for user.
+func (s *Server) deleteUserSessions(user string) error {
+	if us, ok := s.store.(userSessions); ok {
+		return us.DeleteAll(user)
+	}
+	return nil
+}
+
+// Close releases the session store's resources, if it holds any.
+func (s *Server) Close() error {
+	if closer, ok := s.store.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
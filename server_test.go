@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoginRejectsOtherMethods(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil), "RATE_LIMIT_BURST=1")
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	for _, path := range []string{"/login", "/login/github", "/callback"} {
+		// More requests than the burst allows: a 405 must not spend the
+		// visitor's rate limit.
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest(http.MethodDelete, app.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Fatalf("DELETE %s: status %d, want %d", path, resp.StatusCode, http.StatusMethodNotAllowed)
+			}
+			if got := resp.Header.Get("Allow"); got != "GET, HEAD" {
+				t.Errorf("DELETE %s: Allow %q, want %q", path, got, "GET, HEAD")
+			}
+		}
+	}
+
+	if resp, _ := get(t, c, app.URL+"/login"); resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /login after rejected methods: status %d, want %d", resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+}
+
+// headerTransport adds header to every request, like a reverse proxy in
+// front of the app would.
+type headerTransport struct {
+	header http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestForwardedPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        []string
+		prefix     string
+		wantPrefix string
+	}{
+		{"trusted proxy", []string{"TRUST_PROXY=true"}, "/auth", "/auth"},
+		{"nested prefix", []string{"TRUST_PROXY=true"}, "/apps/auth/", "/apps/auth"},
+		// Slashes are trimmed, so this stays a path on the app's host.
+		{"protocol-relative prefix", []string{"TRUST_PROXY=true"}, "//evil.com", "/evil.com"},
+		{"backslash prefix", []string{"TRUST_PROXY=true"}, `/\evil.com`, ""},
+		{"TRUST_PROXY unset", nil, "/auth", ""},
+		{"peer not a trusted proxy", []string{"TRUST_PROXY=true", "TRUSTED_PROXIES=203.0.113.7"}, "/auth", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeGitHub(t, nil), tt.env...)
+			app := httptest.NewServer(s.routes())
+			defer app.Close()
+			c := newBrowser(t)
+			c.Transport = headerTransport{http.Header{"X-Forwarded-Prefix": {tt.prefix}}}
+
+			// requireAuth's redirect to log in.
+			resp, _ := get(t, c, app.URL+"/profile")
+			if got, want := resp.Header.Get("Location"), tt.wantPrefix+"/"; got != want {
+				t.Errorf("GET /profile: Location %q, want %q", got, want)
+			}
+
+			// The callback's redirect to the next page, and the state
+			// cookie scoped to the callback path the browser sees.
+			resp, _ = get(t, c, app.URL+"/login?next=/repos")
+			var stateCookie *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				if cookie.Name == s.stateCookieName() {
+					stateCookie = cookie
+				}
+			}
+			if stateCookie == nil || stateCookie.Path != tt.wantPrefix+"/callback" {
+				t.Errorf("state cookie %v, want path %q", stateCookie, tt.wantPrefix+"/callback")
+			}
+			authURL, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, _ = get(t, c, app.URL+"/callback?code=test-code&state="+url.QueryEscape(authURL.Query().Get("state")))
+			if got, want := resp.Header.Get("Location"), tt.wantPrefix+"/repos"; got != want {
+				t.Errorf("callback: Location %q, want %q", got, want)
+			}
+
+			// Links in rendered pages.
+			_, page := get(t, c, app.URL+"/profile")
+			if want := `href="` + tt.wantPrefix + `/static/style.css"`; !strings.Contains(page, want) {
+				t.Errorf("profile page does not link the stylesheet as %s", want)
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	s := newTestServer(t, newFakeGitHub(t, nil), "BASE_PATH=/app", "TRUST_PROXY=true")
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+	// BASE_PATH wins over the header.
+	c.Transport = headerTransport{http.Header{"X-Forwarded-Prefix": {"/other"}}}
+
+	resp, _ := get(t, c, app.URL+"/app")
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/app/" {
+		t.Errorf("GET /app: status %d, Location %q, want %d to /app/", resp.StatusCode, resp.Header.Get("Location"), http.StatusMovedPermanently)
+	}
+	if resp, _ := get(t, c, app.URL+"/profile"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /profile outside BASE_PATH: status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp = login(t, c, app.URL+"/app", "?next=/repos")
+	if got := resp.Header.Get("Location"); got != "/app/repos" {
+		t.Errorf("callback: Location %q, want /app/repos", got)
+	}
+	if resp, _ := get(t, c, app.URL+"/app/profile"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /app/profile: status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Rate limiting, the concurrency limit and the avatar proxy's 404s answer
+// with the shared error page, or its JSON form for API clients.
+func TestLimitsRenderErrorPage(t *testing.T) {
+	t.Run("rate limit", func(t *testing.T) {
+		s := newTestServer(t, newFakeGitHub(t, nil), "RATE_LIMIT_BURST=1")
+		app := httptest.NewServer(s.routes())
+		defer app.Close()
+		c := newBrowser(t)
+
+		get(t, c, app.URL+"/login")
+		resp, page := get(t, c, app.URL+"/login")
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "60" {
+			t.Errorf("GET /login over the limit: status %d, Retry-After %q, want %d and 60", resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusTooManyRequests)
+		}
+		if !strings.Contains(page, "<title>Too many requests") {
+			t.Errorf("rate limit response is not the error page: %s", page)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, app.URL+"/login", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err = c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); !strings.Contains(body, `"error":"Too many requests, please slow down."`) {
+			t.Errorf("rate limit response for JSON clients = %s", body)
+		}
+	})
+
+	t.Run("concurrency limit", func(t *testing.T) {
+		s := newTestServer(t, newFakeGitHub(t, nil), "MAX_CONCURRENT_REQUESTS=1")
+		release, started := make(chan struct{}), make(chan struct{})
+		app := httptest.NewServer(s.limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})))
+		defer app.Close()
+		go http.Get(app.URL + "/slow")
+		<-started
+
+		resp, page := get(t, newBrowser(t), app.URL+"/")
+		close(release)
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(page, "<title>Server busy") {
+			t.Errorf("request over the limit: status %d, body %s, want %d and the error page", resp.StatusCode, page, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("avatar", func(t *testing.T) {
+		s := newTestServer(t, newFakeGitHub(t, nil), "AVATAR_PROXY=true")
+		app := httptest.NewServer(s.routes())
+		defer app.Close()
+		c := newBrowser(t)
+		login(t, c, app.URL, "")
+
+		resp, page := get(t, c, app.URL+"/avatar/0000000000000000")
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(page, "<title>Page not found") {
+			t.Errorf("GET /avatar with another hash: status %d, body %s, want %d and the error page", resp.StatusCode, page, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// Session value keys. Every read and write of session.Values goes through
+// these so a typo fails to compile instead of silently returning "".
+const (
+	keyProvider    = "provider"
+	keyID          = "id"
+	keyUser        = "user"
+	keyName        = "name"
+	keyEmail       = "email"
+	keyAvatarURL   = "avatar_url"
+	keyPublicRepos = "public_repos"
+	keyFollowers   = "followers"
+	keyToken       = "token"
+	keyLastSeen    = "last_seen"
+	keyLoginAt     = "login_at"
+	keyGeneration  = "generation"
+	keyCSRFToken   = "csrf_token"
+	keyOAuthState  = "oauth_state"
+	keyNext        = "next"
+	keyRemember    = "remember"
+	keyTheme       = "theme"
+	keyScopes      = "scopes"
+)
+
+// SessionData is the typed view of the profile fields stored in a session.
+type SessionData struct {
+	Provider    string `json:"provider"`
+	ID          string `json:"id"`
+	User        string `json:"user"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	AvatarURL   string `json:"avatar_url"`
+	PublicRepos *int   `json:"public_repos,omitempty"`
+	Followers   *int   `json:"followers,omitempty"`
+}
+
+func (d *SessionData) Load(session *sessions.Session) {
+	d.Provider = getStringFromSession(session, keyProvider)
+	d.ID = getStringFromSession(session, keyID)
+	d.User = getStringFromSession(session, keyUser)
+	d.Name = getStringFromSession(session, keyName)
+	d.Email = getStringFromSession(session, keyEmail)
+	d.AvatarURL = getStringFromSession(session, keyAvatarURL)
+
+	d.PublicRepos, d.Followers = nil, nil
+	if n, ok := getIntFromSession(session, keyPublicRepos); ok {
+		d.PublicRepos = &n
+	}
+	if n, ok := getIntFromSession(session, keyFollowers); ok {
+		d.Followers = &n
+	}
+}
+
+// Save writes d into session.Values; the caller is responsible for saving
+// the session itself.
+func (d *SessionData) Save(session *sessions.Session) {
+	session.Values[keyProvider] = d.Provider
+	session.Values[keyID] = d.ID
+	session.Values[keyUser] = d.User
+	session.Values[keyName] = d.Name
+	session.Values[keyEmail] = d.Email
+	session.Values[keyAvatarURL] = d.AvatarURL
+
+	delete(session.Values, keyPublicRepos)
+	if d.PublicRepos != nil {
+		session.Values[keyPublicRepos] = *d.PublicRepos
+	}
+	delete(session.Values, keyFollowers)
+	if d.Followers != nil {
+		session.Values[keyFollowers] = *d.Followers
+	}
+}
+
+// clearProfileData removes the cached profile details while keeping the
+// user logged in; the caller saves the session. POST /profile/refresh
+// fetches them again.
+func clearProfileData(session *sessions.Session) {
+	for _, key := range []string{keyName, keyEmail, keyAvatarURL, keyPublicRepos, keyFollowers} {
+		delete(session.Values, key)
+	}
+}
+
+func newSessionData(provider Provider, user User) SessionData {
+	return SessionData{
+		Provider:    provider.Name(),
+		ID:          user.ID,
+		User:        user.Login,
+		Name:        user.Name,
+		Email:       user.Email,
+		AvatarURL:   user.AvatarURL,
+		PublicRepos: user.PublicRepos,
+		Followers:   user.Followers,
+	}
+}
+
+func (s *Server) loadSessionData(session *sessions.Session) SessionData {
+	var d SessionData
+	d.Load(session)
+	// The avatar URL came from the provider; anything that is not an https
+	// URL on a known avatar host is dropped so the image is simply hidden.
+	d.AvatarURL = normalizeAvatarURL(d.AvatarURL, s.avatarHosts)
+	return d
+}
+
+// session loads the request's session and applies its cookie lifetime. A
+// cookie that fails to decode, whether tampered with, truncated or signed
+// with a retired SESSION_SECRET, is logged, counted and replaced by an empty
+// session so it is not rejected again on every request.
+func (s *Server) session(w http.ResponseWriter, r *http.Request) *sessions.Session {
+	session, err := s.store.Get(r, s.cfg.SessionName)
+	s.applyRemember(session)
+	if err != nil {
+		if isSessionDecodeError(err) {
+			sessionDecodeFailures.Inc()
+			s.log(r).Warn("Discarding undecodable session cookie", "path", r.URL.Path, "error", err)
+			session.Values = make(map[interface{}]interface{})
+			session.IsNew = true
+			if err := session.Save(r, w); err != nil {
+				s.log(r).Error("Failed to reset session", "path", r.URL.Path, "error", err)
+			}
+		} else {
+			s.log(r).Error("Failed to load session", "path", r.URL.Path, "error", err)
+		}
+	}
+	return session
+}
+
+// isSessionDecodeError reports whether err means the session cookie itself
+// was invalid, as opposed to the store being unreachable.
+func isSessionDecodeError(err error) bool {
+	var cookieErr securecookie.Error
+	if errors.As(err, &cookieErr) {
+		return cookieErr.IsDecode()
+	}
+	return errors.Is(err, errJWTMalformed) || errors.Is(err, errJWTSignature) || errors.Is(err, errJWTExpired)
+}
+
+// applyRemember makes a "remember me" session a persistent cookie lasting
+// SESSION_MAX_AGE. Any other session gets a cookie that ends with the
+// browser session.
+func (s *Server) applyRemember(session *sessions.Session) {
+	opts := *session.Options
+	opts.MaxAge = 0
+	if remembered(session) {
+		opts.MaxAge = int(s.cfg.SessionMaxAge.Seconds())
+	}
+	session.Options = &opts
+}
+
+func remembered(session *sessions.Session) bool {
+	remember, _ := session.Values[keyRemember].(bool)
+	return remember
+}
+
+type StoredToken struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+func getStringFromSession(session *sessions.Session, key string) string {
+	if val, ok := session.Values[key]; ok {
+		if str, ok := val.(string); ok {
+			return str
+		}
+	}
+	return ""
+}
+
+func getIntFromSession(session *sessions.Session, key string) (int, bool) {
+	if val, ok := session.Values[key]; ok {
+		if n, ok := val.(int); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func newStoredToken(token *oauth2.Token) *StoredToken {
+	return &StoredToken{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+}
+
+func (t *StoredToken) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.Expiry,
+	}
+}
+
+// getTokenFromSession returns the stored token, refreshing it through the
+// oauth2 token source when it has expired. A refreshed token is written back
+// to session.Values; the caller is responsible for saving the session.
+func (s *Server) getTokenFromSession(ctx context.Context, session *sessions.Session) (*oauth2.Token, *http.Client, error) {
+	stored, ok := session.Values[keyToken].(*StoredToken)
+	if !ok || stored.AccessToken == "" {
+		return nil, nil, errNoToken
+	}
+
+	token := stored.Token()
+	if !token.Valid() && token.RefreshToken == "" {
+		return nil, nil, errTokenExpired
+	}
+
+	provider := s.sessionProvider(session)
+	fresh, err := provider.Config().TokenSource(s.oauthContext(ctx), token).Token()
+	if err != nil {
+		return nil, nil, fmt.Errorf("refresh access token: %w", err)
+	}
+	if fresh.AccessToken != token.AccessToken {
+		session.Values[keyToken] = newStoredToken(fresh)
+	}
+
+	return fresh, s.apiClient(ctx, provider, fresh), nil
+}
+
+// refreshTokenIfExpiring renews the stored token when it expires within
+// TOKEN_REFRESH_WINDOW and has a refresh token, so a request never starts
+// with a token about to lapse.
+// Failures are logged and left for getTokenFromSession to handle once the
+// token has actually expired. The caller saves the session.
+func (s *Server) refreshTokenIfExpiring(r *http.Request, session *sessions.Session) {
+	stored, ok := session.Values[keyToken].(*StoredToken)
+	if !ok || stored.RefreshToken == "" || stored.Expiry.IsZero() {
+		return
+	}
+	if time.Until(stored.Expiry) > s.cfg.TokenRefreshWindow {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.oauthContext(r.Context()), s.cfg.GitHubTimeout)
+	defer cancel()
+
+	// A token without an access token is never valid, which forces the
+	// token source to use the refresh token.
+	config := s.sessionProvider(session).Config()
+	fresh, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: stored.RefreshToken}).Token()
+	if err != nil {
+		s.log(r).Warn("Failed to refresh expiring access token", "path", r.URL.Path, "error", err)
+		return
+	}
+	if fresh.RefreshToken == "" {
+		fresh.RefreshToken = stored.RefreshToken
+	}
+	session.Values[keyToken] = newStoredToken(fresh)
+}
+
+// authenticatedClient returns a GitHub client for the session's token. When
+// the token cannot be used or refreshed the session is cleared and the user
+// is sent back through /login, in which case ok is false.
+func (s *Server) authenticatedClient(w http.ResponseWriter, r *http.Request, session *sessions.Session) (client *http.Client, ok bool) {
+	before := session.Values[keyToken]
+
+	_, client, err := s.getTokenFromSession(r.Context(), session)
+	if err != nil {
+		s.log(r).Warn("Failed to load access token", "path", r.URL.Path, "error", err)
+		session.Values = make(map[interface{}]interface{})
+		session.Save(r, w)
+		http.Redirect(w, r, s.path(r, "/login"), http.StatusSeeOther)
+		return nil, false
+	}
+
+	if session.Values[keyToken] != before {
+		if err := session.Save(r, w); err != nil {
+			s.log(r).Error("Failed to save refreshed token", "path", r.URL.Path, "error", err)
+		}
+	}
+	return client, true
+}
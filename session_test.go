@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestSession(values map[interface{}]interface{}) *sessions.Session {
+	session := sessions.NewSession(nil, "session")
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return session
+}
+
+func TestGetStringFromSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		set   bool
+		want  string
+	}{
+		{"missing key", nil, false, ""},
+		{"int value", 42, true, ""},
+		{"nil value", nil, true, ""},
+		{"string value", "octocat", true, "octocat"},
+		{"empty string", "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[interface{}]interface{}{}
+			if tt.set {
+				values[keyUser] = tt.value
+			}
+			if got := getStringFromSession(newTestSession(values), keyUser); got != tt.want {
+				t.Errorf("getStringFromSession = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetIntFromSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		set    bool
+		want   int
+		wantOK bool
+	}{
+		{"missing key", nil, false, 0, false},
+		{"string value", "12", true, 0, false},
+		{"int64 value", int64(12), true, 0, false},
+		{"int value", 12, true, 12, true},
+		{"zero", 0, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[interface{}]interface{}{}
+			if tt.set {
+				values[keyPublicRepos] = tt.value
+			}
+			got, ok := getIntFromSession(newTestSession(values), keyPublicRepos)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("getIntFromSession = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClearProfileData(t *testing.T) {
+	session := newTestSession(map[interface{}]interface{}{
+		keyProvider:    "github",
+		keyID:          "42",
+		keyUser:        "octocat",
+		keyName:        "The Octocat",
+		keyEmail:       "octo@example.com",
+		keyAvatarURL:   "https://avatars.githubusercontent.com/u/42",
+		keyPublicRepos: 8,
+		keyFollowers:   100,
+		keyToken:       &StoredToken{AccessToken: "gho_access"},
+		keyCSRFToken:   "csrf",
+	})
+
+	clearProfileData(session)
+
+	for _, key := range []string{keyName, keyEmail, keyAvatarURL, keyPublicRepos, keyFollowers} {
+		if _, ok := session.Values[key]; ok {
+			t.Errorf("%s kept after clearProfileData", key)
+		}
+	}
+	// What keeps the user logged in stays.
+	for _, key := range []string{keyProvider, keyID, keyUser, keyToken, keyCSRFToken} {
+		if _, ok := session.Values[key]; !ok {
+			t.Errorf("%s removed by clearProfileData", key)
+		}
+	}
+}
+
+// An undecodable session cookie is counted and replaced by an empty
+// session instead of being rejected on every request.
+func TestSessionResetsUndecodableCookie(t *testing.T) {
+	for _, backend := range []string{"cookie", "jwt"} {
+		t.Run(backend, func(t *testing.T) {
+			s := newTestServer(t, newFakeGitHub(t, nil), "SESSION_BACKEND="+backend)
+			for _, value := range []string{"garbage", strings.Repeat("A", 64)} {
+				before := testutil.ToFloat64(sessionDecodeFailures)
+				req := requestWithCookie(s.cfg.SessionName, value)
+				rec := httptest.NewRecorder()
+
+				session := s.session(rec, req)
+				if !session.IsNew || len(session.Values) != 0 {
+					t.Errorf("cookie %q: session = %v, want a new empty one", value, session.Values)
+				}
+				if got := testutil.ToFloat64(sessionDecodeFailures) - before; got != 1 {
+					t.Errorf("cookie %q: counted %v decode failures, want 1", value, got)
+				}
+				cookies := rec.Result().Cookies()
+				if len(cookies) != 1 || cookies[0].Name != s.cfg.SessionName || cookies[0].Value == value {
+					t.Errorf("cookie %q: response cookies %v, want a replacement session cookie", value, cookies)
+				}
+			}
+
+			// No cookie at all is not a decode failure.
+			before := testutil.ToFloat64(sessionDecodeFailures)
+			rec := httptest.NewRecorder()
+			s.session(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if testutil.ToFloat64(sessionDecodeFailures) != before || len(rec.Result().Cookies()) != 0 {
+				t.Error("a request without a session cookie was treated as a decode failure")
+			}
+		})
+	}
+}
+
+func TestIsSessionDecodeError(t *testing.T) {
+	_, cookieErr := newCookieStore([][]byte{[]byte(testSessionSecret)}, testSessionOptions()).New(
+		requestWithCookie("session", "garbage"), "session")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"securecookie decode", cookieErr, true},
+		{"malformed JWT", fmt.Errorf("load session: %w", errJWTMalformed), true},
+		{"bad JWT signature", errJWTSignature, true},
+		{"expired JWT", errJWTExpired, true},
+		{"store unreachable", errors.New("dial tcp 127.0.0.1:6379: connect: connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isSessionDecodeError(tt.err); got != tt.want {
+			t.Errorf("%s: isSessionDecodeError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func requestWithCookie(name, value string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: name, Value: value})
+	return req
+}
@@ -0,0 +1,46 @@
+package main
+
+import "net/http"
+
+// stateCookieName is namespaced by the session name so apps sharing a
+// domain do not overwrite each other's login state.
+func (s *Server) stateCookieName() string {
+	return s.cfg.SessionName + "_oauth_state"
+}
+
+// setStateCookie stores the OAuth state nonce in a short-lived cookie
+// scoped to the callback path. It is a double-submit fallback for when the
+// session cookie does not survive the round trip through the provider.
+func (s *Server) setStateCookie(w http.ResponseWriter, r *http.Request, nonce string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.stateCookieName(),
+		Value:    nonce,
+		Path:     s.path(r, "/callback"),
+		Domain:   s.cfg.CookieDomain,
+		MaxAge:   int(stateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   s.cfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// stateFromCookie returns the nonce set by setStateCookie.
+func (s *Server) stateFromCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie(s.stateCookieName())
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	return c.Value, true
+}
+
+func (s *Server) clearStateCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.stateCookieName(),
+		Path:     s.path(r, "/callback"),
+		Domain:   s.cfg.CookieDomain,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.cfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// staticHandler serves /static/ from the embedded static directory, or from
+// disk in DEV mode. Paths are resolved through fs.FS, which rejects ".."
+// elements, so nothing outside the static root can be reached.
+func staticHandler(dev bool) http.Handler {
+	var root fs.FS
+	if dev {
+		root = os.DirFS("static")
+	} else {
+		sub, err := fs.Sub(staticFS, "static")
+		if err != nil {
+			panic(err)
+		}
+		root = sub
+	}
+
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(root)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if dev {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
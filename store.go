@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/boj/redistore"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func newSessionStore(cfg *Config, opts *sessions.Options) (sessions.Store, error) {
+	if cfg.SessionBackend == "redis" {
+		if cfg.RedisURL == "" {
+			slog.Warn("SESSION_BACKEND=redis but REDIS_URL is not set, falling back to cookie sessions")
+			return newCookieStore(cfg.SessionSecrets, opts), nil
+		}
+		return newRedisStore(cfg.RedisURL, cfg.SessionSecrets, opts)
+	}
+	if cfg.SessionBackend == "jwt" {
+		slog.Info("Using JWT session cookies")
+		return newJWTStore(cfg.SessionSecrets, opts, cfg.SessionMaxAge), nil
+	}
+	return newCookieStore(cfg.SessionSecrets, opts), nil
+}
+
+// keyPairs turns the session secrets into the hash/block key pairs gorilla
+// stores expect. Each secret signs as is and encrypts with a key derived
+// from it, so cookies holding the OAuth token cannot be read by anyone who
+// obtains them. The first pair encodes and every pair is tried when
+// decoding, so old secrets keep validating existing cookies through a
+// rotation.
+func keyPairs(secrets [][]byte) [][]byte {
+	pairs := make([][]byte, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, encryptionKey(secret))
+	}
+	return pairs
+}
+
+// encryptionKey derives a 32 byte AES-256 key from a session secret. It is
+// kept distinct from the secret itself, which is already used for HMACs.
+func encryptionKey(secret []byte) []byte {
+	return hmacSHA256(secret, "session encryption key")
+}
+
+func newCookieStore(secrets [][]byte, opts *sessions.Options) *sessions.CookieStore {
+	cs := sessions.NewCookieStore(keyPairs(secrets)...)
+	cs.Options = opts
+	// The codecs keep their own 30 day limit unless told otherwise.
+	cs.MaxAge(opts.MaxAge)
+	return cs
+}
+
+func newRedisStore(redisURL string, secrets [][]byte, opts *sessions.Options) (*redisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(redisURL)
+		},
+	}
+
+	rs, err := redistore.NewRediStoreWithPool(pool, keyPairs(secrets)...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to redis session store: %w", err)
+	}
+	rs.Options = opts
+	rs.SetMaxAge(opts.MaxAge)
+
+	slog.Info("Using redis session store")
+	return &redisStore{RediStore: rs, ttl: opts.MaxAge}, nil
+}
+
+// redisStore fixes how redistore handles browser-session cookies. Its Save
+// treats MaxAge 0 like a negative MaxAge and deletes the session, so a login
+// without "Remember me" would be gone on the next request. Here 0 keeps the
+// Redis entry for ttl seconds and sends a cookie without Max-Age; only a
+// negative MaxAge deletes.
+type redisStore struct {
+	*redistore.RediStore
+	ttl int
+}
+
+func (s *redisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session through redistore, then rebinds it to s so that
+// session.Save comes back here.
+func (s *redisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	loaded, err := s.RediStore.New(r, name)
+	session := sessions.NewSession(s, name)
+	session.ID = loaded.ID
+	session.Values = loaded.Values
+	session.Options = loaded.Options
+	session.IsNew = loaded.IsNew
+	return session, err
+}
+
+func (s *redisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge != 0 {
+		return s.RediStore.Save(r, w, session)
+	}
+
+	// Write the Redis entry with the session lifetime as its TTL, dropping
+	// the persistent cookie redistore sets for it, then send the
+	// browser-session cookie ourselves.
+	opts := session.Options
+	stored := *opts
+	stored.MaxAge = s.ttl
+	session.Options = &stored
+	err := s.RediStore.Save(r, discardResponse{}, session)
+	session.Options = opts
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, opts))
+	return nil
+}
+
+// Renew deletes session's Redis entry and clears its ID, so the next Save
+// stores the values under a fresh ID. A cookie holding the old ID then loads
+// an empty session.
+func (s *redisStore) Renew(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	values := session.Values
+	session.Values = make(map[interface{}]interface{})
+	err := s.RediStore.Delete(nil, discardResponse{}, session)
+	session.Values = values
+	if err != nil {
+		return err
+	}
+	session.ID = ""
+	return nil
+}
+
+// Track records session's ID in user's set of sessions, so DeleteAll can
+// find it. The set expires with the newest session in it.
+func (s *redisStore) Track(user string, session *sessions.Session) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SADD", userSessionsKey(user), session.ID); err != nil {
+		return err
+	}
+	_, err := conn.Do("EXPIRE", userSessionsKey(user), s.ttl)
+	return err
+}
+
+// DeleteAll deletes the Redis entry of every session recorded for user by
+// Track, on any device.
+func (s *redisStore) DeleteAll(user string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", userSessionsKey(user)))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		session := sessions.NewSession(s, "")
+		session.ID = id
+		session.Options = s.Options
+		if err := s.RediStore.Delete(nil, discardResponse{}, session); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Do("DEL", userSessionsKey(user))
+	return err
+}
+
+func userSessionsKey(user string) string {
+	return "user_sessions:" + user
+}
+
+// discardResponse is a ResponseWriter that throws away whatever is written
+// to it.
+type discardResponse struct{}
+
+func (discardResponse) Header() http.Header         { return http.Header{} }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
+
+// generationStore tracks a per-user session generation. Sessions record the
+// generation they were issued under and are rejected once it has been bumped,
+// which lets a user invalidate every outstanding cookie at once.
+type generationStore interface {
+	Current(user string) (int64, error)
+	Bump(user string) (int64, error)
+}
+
+// errRevocationUnsupported is returned by Bump when there is no shared
+// store to record the new generation in.
+var errRevocationUnsupported = errors.New("revoking sessions requires SESSION_BACKEND=redis")
+
+// newGenerationStore keeps generations next to redis sessions. Cookie and
+// JWT sessions get cookieGenerations instead.
+func newGenerationStore(s sessions.Store) generationStore {
+	if rs, ok := s.(*redisStore); ok {
+		return &redisGenerations{pool: rs.Pool}
+	}
+	return cookieGenerations{}
+}
+
+// cookieGenerations is used when sessions live only in cookies. Generations
+// kept in process memory would be forgotten on restart, reviving revoked
+// cookies, and would not reach other replicas, so every session stays at
+// generation 0 and Bump refuses.
+type cookieGenerations struct{}
+
+func (cookieGenerations) Current(user string) (int64, error) { return 0, nil }
+
+func (cookieGenerations) Bump(user string) (int64, error) {
+	return 0, errRevocationUnsupported
+}
+
+type redisGenerations struct {
+	pool *redis.Pool
+}
+
+func (g *redisGenerations) Current(user string) (int64, error) {
+	conn := g.pool.Get()
+	defer conn.Close()
+
+	gen, err := redis.Int64(conn.Do("GET", generationKey(user)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return gen, err
+}
+
+func (g *redisGenerations) Bump(user string) (int64, error) {
+	conn := g.pool.Get()
+	defer conn.Close()
+	return redis.Int64(conn.Do("INCR", generationKey(user)))
+}
+
+func generationKey(user string) string {
+	return "session_generation:" + user
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// fakeRedis speaks just enough of the Redis protocol for the session and
+// generation stores: PING, GET, SETEX, DEL, INCR, SADD, SMEMBERS and
+// EXPIRE.
+type fakeRedis struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	data map[string]string
+	sets map[string][]string
+	ttls map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, data: make(map[string]string), sets: make(map[string][]string), ttls: make(map[string]int)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) URL() string {
+	return "redis://" + f.ln.Addr().String()
+}
+
+// keys returns the stored keys starting with prefix and their TTLs.
+func (f *fakeRedis) keys(prefix string) map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make(map[string]int)
+	for k := range f.data {
+		if strings.HasPrefix(k, prefix) {
+			keys[k] = f.ttls[k]
+		}
+	}
+	for k := range f.sets {
+		if strings.HasPrefix(k, prefix) {
+			keys[k] = f.ttls[k]
+		}
+	}
+	return keys
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, f.do(args))
+	}
+}
+
+func (f *fakeRedis) do(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := f.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SETEX":
+		ttl, err := strconv.Atoi(args[2])
+		if err != nil || ttl <= 0 {
+			return "-ERR invalid expire time in 'setex' command\r\n"
+		}
+		f.data[args[1]] = args[3]
+		f.ttls[args[1]] = ttl
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := f.data[k]; ok {
+				delete(f.data, k)
+				n++
+			}
+			if _, ok := f.sets[k]; ok {
+				delete(f.sets, k)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "INCR":
+		n, _ := strconv.Atoi(f.data[args[1]])
+		n++
+		f.data[args[1]] = strconv.Itoa(n)
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SADD":
+		n := 0
+		for _, member := range args[2:] {
+			if !slices.Contains(f.sets[args[1]], member) {
+				f.sets[args[1]] = append(f.sets[args[1]], member)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SMEMBERS":
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(f.sets[args[1]]))
+		for _, member := range f.sets[args[1]] {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(member), member)
+		}
+		return b.String()
+	case "EXPIRE":
+		ttl, _ := strconv.Atoi(args[2])
+		f.ttls[args[1]] = ttl
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// readCommand reads one command sent as a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad array header %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad bulk header %q", header)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStoreKeepsBrowserSessions(t *testing.T) {
+	redis := newFakeRedis(t)
+	s := newTestServer(t, newFakeGitHub(t, nil),
+		"SESSION_BACKEND=redis",
+		"REDIS_URL="+redis.URL(),
+		"SESSION_MAX_AGE=2h",
+	)
+	app := httptest.NewServer(s.routes())
+	defer app.Close()
+	c := newBrowser(t)
+
+	// No "Remember me": the cookie must end with the browser session while
+	// the Redis entry lives for SESSION_MAX_AGE.
+	resp := login(t, c, app.URL, "")
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback: status %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == s.cfg.SessionName && (cookie.MaxAge != 0 || !cookie.Expires.IsZero()) {
+			t.Errorf("session cookie is persistent: Max-Age %d, Expires %v", cookie.MaxAge, cookie.Expires)
+		}
+	}
+
+	sessions := redis.keys("session_")
+	if len(sessions) != 1 {
+		t.Fatalf("redis holds %d sessions, want 1", len(sessions))
+	}
+	for key, ttl := range sessions {
+		if ttl != 2*60*60 {
+			t.Errorf("%s TTL = %d, want %d", key, ttl, 2*60*60)
+		}
+	}
+
+	resp, page := get(t, c, app.URL+"/profile")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(page, "octocat") {
+		t.Fatalf("GET /profile: status %d, want the logged-in profile", resp.StatusCode)
+	}
+
+	// A negative MaxAge still deletes the entry.
+	req := httptest.NewRequest(http.MethodGet, app.URL+"/", nil)
+	for _, cookie := range c.Jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+	session, err := s.store.Get(req, s.cfg.SessionName)
+	if err != nil || session.IsNew {
+		t.Fatalf("load session from redis: new %v, error %v", session.IsNew, err)
+	}
+	session.Options.MaxAge = -1
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(redis.keys("session_")); n != 0 {
+		t.Errorf("redis holds %d sessions after delete, want 0", n)
+	}
+}
+
+// roundTrip saves a new session holding values with store and loads it back
+// from the resulting cookie. It returns the loaded session and the cookie
+// value.
+func roundTrip(t *testing.T, store sessions.Store, values map[interface{}]interface{}) (*sessions.Session, string) {
+	t.Helper()
+	cookie := saveSession(t, store, values)
+	loaded, err := loadSession(store, cookie)
+	if err != nil {
+		t.Fatalf("load saved session: %v", err)
+	}
+	return loaded, cookie.Value
+}
+
+func testSessionOptions() *sessions.Options {
+	return &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true}
+}
+
+func TestCookieStoreEncryptsSessions(t *testing.T) {
+	const accessToken = "gho_secretaccesstoken"
+	store := newCookieStore([][]byte{[]byte(testSessionSecret)}, testSessionOptions())
+	_, value := roundTrip(t, store, map[interface{}]interface{}{
+		keyToken: &StoredToken{AccessToken: accessToken, TokenType: "bearer"},
+	})
+
+	// securecookie encodes base64(date|value|mac), value being the base64
+	// of the serialized, and here encrypted, session. The binary MAC may
+	// itself contain "|".
+	outer, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := bytes.SplitN(outer, []byte("|"), 3)
+	if len(parts) != 3 {
+		t.Fatalf("cookie has %d fields, want 3", len(parts))
+	}
+	inner, err := base64.URLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(inner, []byte(accessToken)) {
+		t.Fatal("access token is readable in the session cookie")
+	}
+}
+
+func TestStoredTokenRoundTrip(t *testing.T) {
+	secrets := [][]byte{[]byte(testSessionSecret)}
+	redisStore, err := newRedisStore(newFakeRedis(t).URL(), secrets, testSessionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]sessions.Store{
+		"cookie": newCookieStore(secrets, testSessionOptions()),
+		"jwt":    newJWTStore(secrets, testSessionOptions(), time.Hour),
+		"redis":  redisStore,
+	}
+
+	token := &StoredToken{
+		AccessToken:  "gho_access",
+		TokenType:    "bearer",
+		RefreshToken: "ghr_refresh",
+		Expiry:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			loaded, _ := roundTrip(t, store, map[interface{}]interface{}{
+				keyUser:  "octocat",
+				keyToken: token,
+			})
+
+			got, ok := loaded.Values[keyToken].(*StoredToken)
+			if !ok {
+				t.Fatalf("token loaded as %T, want *StoredToken", loaded.Values[keyToken])
+			}
+			if got.AccessToken != token.AccessToken || got.TokenType != token.TokenType ||
+				got.RefreshToken != token.RefreshToken || !got.Expiry.Equal(token.Expiry) {
+				t.Errorf("token = %+v, want %+v", got, token)
+			}
+			if user := getStringFromSession(loaded, keyUser); user != "octocat" {
+				t.Errorf("user = %q, want octocat", user)
+			}
+		})
+	}
+}
+
+// After a SESSION_SECRET rotation, cookies signed with the old key still
+// load while it is listed after the new one, and new cookies are signed
+// with the new key.
+func TestSessionSecretRotation(t *testing.T) {
+	oldKey := []byte(testSessionSecret)
+	newKey := []byte("a-new-session-secret-of-32-bytes!")
+	stores := map[string]func(secrets [][]byte) sessions.Store{
+		"cookie": func(secrets [][]byte) sessions.Store { return newCookieStore(secrets, testSessionOptions()) },
+		"jwt":    func(secrets [][]byte) sessions.Store { return newJWTStore(secrets, testSessionOptions(), time.Hour) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			before := newStore([][]byte{oldKey})
+			rotated := newStore([][]byte{newKey, oldKey})
+			retired := newStore([][]byte{newKey})
+
+			cookie := saveSession(t, before, map[interface{}]interface{}{keyUser: "octocat"})
+			session, err := loadSession(rotated, cookie)
+			if err != nil {
+				t.Fatalf("rotated store rejects a cookie signed with the old key: %v", err)
+			}
+			if session.Values[keyUser] != "octocat" {
+				t.Errorf("user = %v, want octocat", session.Values[keyUser])
+			}
+			if _, err := loadSession(retired, cookie); err == nil {
+				t.Error("store without the old key accepts its cookie")
+			}
+
+			cookie = saveSession(t, rotated, map[interface{}]interface{}{keyUser: "octocat"})
+			if _, err := loadSession(retired, cookie); err != nil {
+				t.Errorf("rotated store does not sign with the new key: %v", err)
+			}
+		})
+	}
+}
+
+// saveSession saves a new session holding values with store and returns its
+// cookie.
+func saveSession(t *testing.T, store sessions.Store, values map[interface{}]interface{}) *http.Cookie {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.New(req, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Save set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func loadSession(store sessions.Store, cookie *http.Cookie) (*sessions.Session, error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	return store.New(req, "session")
+}